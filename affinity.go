@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AffinityConfig keeps the requests of a client on the same upstream, as long as it is healthy. The upstream is either
+// remembered in a cookie issued by Iridium, or learned from a session cookie set by the upstream.
+type AffinityConfig struct {
+	// Name of the affinity cookie issued by Iridium. Default is "iridium_affinity".
+	Cookie string `yaml:"cookie,omitempty"`
+	// Name of a session cookie set by the upstreams, e.g. "JSESSIONID". If set, no cookie is issued: requests carrying
+	// a session are routed to the upstream that created it.
+	LearnCookie string `yaml:"learn_cookie,omitempty"`
+	// Lifetime of the affinity cookie, or of learned sessions without requests, in seconds. If not set, the affinity
+	// cookie lasts for the browser session and learned sessions expire after 1 hour.
+	MaxAge int `yaml:"max_age,omitempty"`
+	// SameSite attribute of the affinity cookie: Strict, Lax or None. Default is Lax.
+	SameSite string `yaml:"same_site,omitempty"`
+	// Always set the Secure attribute of the affinity cookie. It is always set for HTTPS requests.
+	Secure bool `yaml:"secure,omitempty"`
+	// Path of the affinity cookie. Default is "/".
+	Path string `yaml:"path,omitempty"`
+
+	// Host and location the sessions are learned for, so that locations sharing a session cookie name don't share
+	// sessions
+	scope string
+}
+
+type learnedSession struct {
+	upstream string
+	expires  time.Time
+}
+
+var learnedSessionsMu sync.Mutex
+var learnedSessions = make(map[string]learnedSession)
+var learnedSessionsCleanup time.Time
+
+// UpstreamAffinityID returns the identifier of an upstream stored in affinity cookies: an HMAC of its address keyed
+// with "waf.encryption_key", so that clients can neither learn the address nor forge a cookie for a chosen upstream.
+func UpstreamAffinityID(upstream string) string {
+	key := GetConfigValue("waf.encryption_key", generateWAFEncryptionKey()).(string)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("iridium-affinity:" + upstream))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (affinity *AffinityConfig) cookieName() string {
+	if affinity.Cookie == "" {
+		return "iridium_affinity"
+	}
+	return affinity.Cookie
+}
+
+// sessionKey returns the key of a session of the learned cookie in learnedSessions.
+func (affinity *AffinityConfig) sessionKey(session string) string {
+	return affinity.scope + " " + affinity.LearnCookie + "=" + session
+}
+
+func (affinity *AffinityConfig) sessionTTL() time.Duration {
+	if affinity.MaxAge <= 0 {
+		return time.Hour
+	}
+	return time.Duration(affinity.MaxAge) * time.Second
+}
+
+// PreferredUpstream returns the member of the pool the request is bound to, if it is still healthy.
+func (affinity *AffinityConfig) PreferredUpstream(request HttpRequest, pool *UpstreamPool) (string, bool) {
+	if affinity == nil {
+		return "", false
+	}
+	cookies := ParseCookies(request.Headers["cookie"])
+	var upstream string
+	if affinity.LearnCookie != "" {
+		session, ok := cookies[affinity.LearnCookie]
+		if !ok {
+			return "", false
+		}
+		learnedSessionsMu.Lock()
+		learned, found := learnedSessions[affinity.sessionKey(session)]
+		if found && time.Now().After(learned.expires) {
+			delete(learnedSessions, affinity.sessionKey(session))
+			found = false
+		}
+		learnedSessionsMu.Unlock()
+		// The upstream may have been removed, or belong to another split group
+		if !found || !slices.Contains(pool.Members(), learned.upstream) {
+			return "", false
+		}
+		upstream = learned.upstream
+	} else {
+		id, ok := cookies[affinity.cookieName()]
+		if !ok {
+			return "", false
+		}
+		for _, member := range pool.Members() {
+			if hmac.Equal([]byte(UpstreamAffinityID(member)), []byte(id)) {
+				upstream = member
+				break
+			}
+		}
+	}
+	if upstream == "" || !IsUpstreamHealthy(upstream) {
+		return "", false
+	}
+	return upstream, true
+}
+
+// Track binds the client to the upstream that answered the request. In learn mode, sessions created by the upstream
+// are recorded. Otherwise, the affinity cookie to send to the client is returned, if it must be (re)issued.
+func (affinity *AffinityConfig) Track(request HttpRequest, responseHeaders map[string]string, upstream string) string {
+	if affinity == nil {
+		return ""
+	}
+	cookies := ParseCookies(request.Headers["cookie"])
+	if affinity.LearnCookie != "" {
+		learnedSessionsMu.Lock()
+		defer learnedSessionsMu.Unlock()
+		expires := time.Now().Add(affinity.sessionTTL())
+		if session, ok := cookies[affinity.LearnCookie]; ok {
+			if learned, found := learnedSessions[affinity.sessionKey(session)]; found && learned.upstream == upstream {
+				learnedSessions[affinity.sessionKey(session)] = learnedSession{upstream: upstream, expires: expires}
+			}
+		}
+		for _, line := range strings.Split(responseHeaders["set-cookie"], "\n") {
+			pair, _, _ := strings.Cut(line, ";")
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && name == affinity.LearnCookie && value != "" {
+				learnedSessions[affinity.sessionKey(value)] = learnedSession{upstream: upstream, expires: expires}
+			}
+		}
+		if time.Since(learnedSessionsCleanup) > time.Minute {
+			learnedSessionsCleanup = time.Now()
+			for key, learned := range learnedSessions {
+				if time.Now().After(learned.expires) {
+					delete(learnedSessions, key)
+				}
+			}
+		}
+		return ""
+	}
+
+	id := UpstreamAffinityID(upstream)
+	if cookies[affinity.cookieName()] == id && affinity.MaxAge <= 0 {
+		return ""
+	}
+	path := affinity.Path
+	if path == "" {
+		path = "/"
+	}
+	sameSite := affinity.SameSite
+	if sameSite == "" {
+		sameSite = "Lax"
+	}
+	var maxAge *int
+	if affinity.MaxAge > 0 {
+		maxAge = IntPtr(affinity.MaxAge)
+	}
+	secure := affinity.Secure || request.Scheme == "https" || strings.EqualFold(sameSite, "None")
+	return SetCookie(affinity.cookieName(), id, &path, nil, maxAge, secure, true, sameSite)
+}
+
+// Validate checks the SameSite option.
+func (affinity *AffinityConfig) Validate() error {
+	if affinity == nil || affinity.SameSite == "" {
+		return nil
+	}
+	switch strings.ToLower(affinity.SameSite) {
+	case "strict", "lax", "none":
+		return nil
+	}
+	return fmt.Errorf("invalid affinity same_site: %s", affinity.SameSite)
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/gzip"
@@ -52,42 +53,70 @@ func CompressData(in io.Reader, lib string) (io.Reader, error) {
 	}
 }
 
-func DecompressBody(bufReader *bufio.Reader, lib string) (io.Reader, error) {
-	var out bytes.Buffer
+// NewDecompressReader returns a reader that decompresses the data read from in, as it is read.
+func NewDecompressReader(in io.Reader, lib string) (io.ReadCloser, error) {
 	switch lib {
 	case "deflate":
-		reader := flate.NewReader(bufReader)
-		defer reader.Close()
-		_, err := io.Copy(&out, reader)
-		if err != nil {
-			return nil, err
-		}
+		return flate.NewReader(in), nil
 	case "gzip":
-		reader, err := gzip.NewReader(bufReader)
+		reader, err := gzip.NewReader(in)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 		}
-		defer reader.Close()
-
-		// Let gzip reader read until it finds the natural end
-		_, err = io.Copy(&out, reader)
-		if err != nil {
-			return nil, fmt.Errorf("gzip decompression failed: %w", err)
-		}
+		return reader, nil
 	case "zstd":
-		reader, err := zstd.NewReader(bufReader)
+		reader, err := zstd.NewReader(in)
 		if err != nil {
 			return nil, err
 		}
-		defer reader.Close()
-
-		_, err = io.Copy(&out, reader)
-		if err != nil {
-			return nil, fmt.Errorf("zstd decompression failed: %w", err)
-		}
+		return reader.IOReadCloser(), nil
 	default:
 		return nil, fmt.Errorf("unsupported compression: %s", lib)
 	}
+}
+
+// SupportedEncodings are the content encodings that can be compressed and decompressed, in order of preference.
+var SupportedEncodings = []string{"zstd", "gzip", "deflate"}
+
+// AcceptsEncoding reports whether the value of an Accept-Encoding header allows the given content encoding.
+func AcceptsEncoding(acceptEncoding, encoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
 
-	return &out, nil
+// UpstreamAcceptEncoding returns the Accept-Encoding header sent to upstreams: the encodings accepted by the client
+// that can also be decompressed, so that the body of the response can be sent to the client as is.
+func UpstreamAcceptEncoding(clientAcceptEncoding string) string {
+	var encodings []string
+	for _, encoding := range SupportedEncodings {
+		if AcceptsEncoding(clientAcceptEncoding, encoding) {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		return "identity"
+	}
+	return strings.Join(encodings, ", ")
+}
+
+// DecompressBody decompresses a body encoded with the given content encoding.
+func DecompressBody(body []byte, encoding string) ([]byte, error) {
+	reader, err := NewDecompressReader(bytes.NewReader(body), strings.ToLower(encoding))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
 }
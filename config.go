@@ -52,15 +52,59 @@ server:
   show_server_version: true
   # Options: none, zstd, gzip, deflate
   encoding: none
+  # Time allowed to clients to send a request, in seconds. Slower clients receive a 408 response.
+  client_timeout: 60
+  # List of IPs or CIDR ranges of proxies (e.g. load balancers) in front of Iridium.
+  # X-Forwarded-For and Forwarded headers are only used to find the client IP when sent by these proxies.
+  trusted_proxies: []
+  # Read a PROXY protocol (v1 or v2) header on incoming connections, e.g. when running behind a TCP load balancer.
+  proxy_protocol:
+    enabled: false
+    # List of IPs or CIDR ranges allowed to send a PROXY protocol header. Other peers are treated as regular clients.
+    trusted_cidrs: []
+  # Response to requests whose Host header doesn't match any host. A host with "default: true" is used instead if
+  # there is one.
+  unmatched_host:
+    # Options: welcome (built-in welcome page), status (respond with the status below), close (close the connection)
+    action: welcome
+    # Default is 421 (Misdirected Request).
+    status: 421
+    # HTML file sent with the status, instead of the built-in error page. It is read at startup.
+    page: ""
+
+tls:
+  # Certificate and private key files. When set, Iridium serves HTTPS on port 443 and redirects HTTP to HTTPS.
+  cert_file: ""
+  key_file: ""
+  # Action for TLS connections whose server name (SNI) doesn't match any host.
+  # Options: terminate (serve them like other connections), reject (fail the TLS handshake), passthrough (forward
+  # them as is). Terminated connections are then answered like other requests for unknown hosts.
+  unknown_sni: terminate
+  # Address receiving the connections with an unknown server name, e.g. "10.0.0.5:443", if unknown_sni is passthrough.
+  unknown_sni_upstream: ""
+
+discovery:
+  # Time between two polls of the discovery providers, in seconds.
+  interval: 5
+  # JSON file listing upstreams, reloaded when it changes. Example: [{"service": "api", "address": "10.0.0.5:8080"}]
+  # Upstreams with a "host" generate a host with that domain, unless a host file already matches it.
+  file: ""
+  docker:
+    # Discover the containers with an "iridium.host" or "iridium.service" label, using the Docker Engine API.
+    # Other labels: "iridium.port" (container port), "iridium.scheme" (http or https), "iridium.network".
+    enabled: false
+    socket: /var/run/docker.sock
 `
 
 var config *Config
 var configMap *map[string]interface{}
 
 type Config struct {
-	WAF     WAFConfig     `yaml:"waf"`
-	Logging LoggingConfig `yaml:"logging"`
-	Server  ServerConfig  `yaml:"server"`
+	WAF       WAFConfig       `yaml:"waf"`
+	Logging   LoggingConfig   `yaml:"logging"`
+	Server    ServerConfig    `yaml:"server"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Discovery DiscoveryConfig `yaml:"discovery"`
 }
 
 type WAFConfig struct {
@@ -81,9 +125,42 @@ type LoggingConfig struct {
 }
 
 type ServerConfig struct {
-	Port              int    `yaml:"port"`
-	ShowServerVersion bool   `yaml:"show_server_version"`
-	Encoding          string `yaml:"encoding"`
+	Port              int                 `yaml:"port"`
+	ShowServerVersion bool                `yaml:"show_server_version"`
+	Encoding          string              `yaml:"encoding"`
+	ClientTimeout     int                 `yaml:"client_timeout"`
+	TrustedProxies    []string            `yaml:"trusted_proxies"`
+	ProxyProtocol     ProxyProtocolConfig `yaml:"proxy_protocol"`
+	UnmatchedHost     UnmatchedHostConfig `yaml:"unmatched_host"`
+}
+
+type UnmatchedHostConfig struct {
+	Action string `yaml:"action"`
+	Status int    `yaml:"status"`
+	Page   string `yaml:"page"`
+}
+
+type TLSConfig struct {
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	UnknownSNI         string `yaml:"unknown_sni"`
+	UnknownSNIUpstream string `yaml:"unknown_sni_upstream"`
+}
+
+type DiscoveryConfig struct {
+	Interval int                   `yaml:"interval"`
+	File     string                `yaml:"file"`
+	Docker   DockerDiscoveryConfig `yaml:"docker"`
+}
+
+type DockerDiscoveryConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Socket  string `yaml:"socket"`
+}
+
+type ProxyProtocolConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	TrustedCIDRs []string `yaml:"trusted_cidrs"`
 }
 
 func CreateDefaultConfig() error {
@@ -195,3 +272,28 @@ func generateWAFEncryptionKey() string {
 	encryptionKey = fmt.Sprintf("%x", key)
 	return encryptionKey
 }
+
+// PrepareConfig loads the settings that are parsed once at startup instead of on every request, and returns an error
+// if one of them is invalid.
+func PrepareConfig() error {
+	if err := LoadTrustedProxies(); err != nil {
+		return err
+	}
+	if err := LoadProxyProtocolTrusted(); err != nil {
+		return err
+	}
+	return LoadUnmatchedHost()
+}
+
+// GetConfigStringList returns the list of strings at the given key, or an empty list if the key is not a list.
+func GetConfigStringList(key string) []string {
+	values, ok := GetConfigValue(key, []interface{}{}).([]interface{})
+	if !ok {
+		return nil
+	}
+	var list []string
+	for _, value := range values {
+		list = append(list, fmt.Sprint(value))
+	}
+	return list
+}
@@ -19,7 +19,8 @@ func ParseCookies(cookieHeader string) map[string]string {
 	return cookies
 }
 
-func SetCookie(name, value string, path, domain *string, maxAge *int, secure, httpOnly bool) string {
+// SetCookie builds the value of a Set-Cookie header. sameSite is "Strict", "Lax" or "None", or empty to omit it.
+func SetCookie(name, value string, path, domain *string, maxAge *int, secure, httpOnly bool, sameSite string) string {
 	cookie := fmt.Sprintf("%s=%s", name, value)
 	if path != nil {
 		cookie += fmt.Sprintf("; Path=%s", *path)
@@ -36,5 +37,8 @@ func SetCookie(name, value string, path, domain *string, maxAge *int, secure, ht
 	if httpOnly {
 		cookie += "; HttpOnly"
 	}
+	if sameSite != "" {
+		cookie += fmt.Sprintf("; SameSite=%s", sameSite)
+	}
 	return cookie
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DiscoveredUpstream is an upstream found by a discovery provider.
+type DiscoveredUpstream struct {
+	// Service the upstream belongs to, added to the locations with the same "discover" value.
+	Service string `json:"service,omitempty"`
+	// Domain of the host generated for this upstream, unless a host file already matches it.
+	Host string `json:"host,omitempty"`
+	// Address of the upstream, e.g. "http://10.0.0.5:8080".
+	Address string `json:"address"`
+}
+
+// DiscoveryProvider finds upstreams outside the host files, e.g. in a file written by deployment tools or in Docker.
+type DiscoveryProvider interface {
+	// Name identifies the provider in logs and upstream pools.
+	Name() string
+	// Discover returns every upstream currently known by the provider.
+	Discover() ([]DiscoveredUpstream, error)
+}
+
+// LoadDiscoveryProviders returns the providers enabled in the "discovery" section of the config.
+func LoadDiscoveryProviders() []DiscoveryProvider {
+	var providers []DiscoveryProvider
+	if path := GetConfigValue("discovery.file", "").(string); path != "" {
+		providers = append(providers, &FileDiscovery{Path: path})
+	}
+	if enabled, _ := GetConfigValue("discovery.docker.enabled", false).(bool); enabled {
+		socket := GetConfigValue("discovery.docker.socket", "/var/run/docker.sock").(string)
+		providers = append(providers, NewDockerDiscovery(socket))
+	}
+	return providers
+}
+
+// DiscoveryInterval returns the time between two polls of the discovery providers.
+func DiscoveryInterval() time.Duration {
+	seconds, _ := GetConfigValue("discovery.interval", 5).(int)
+	if seconds <= 0 {
+		seconds = 5
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// StartDiscovery polls the providers once, then keeps polling them in the background. The upstreams of each service
+// are added to the pools of the locations discovering it, and the upstreams with a host generate hosts in the store.
+// When a provider fails, its previous upstreams are kept.
+func StartDiscovery(store *HostStore, providers []DiscoveryProvider) {
+	if len(providers) == 0 {
+		return
+	}
+	results := make(map[string][]DiscoveredUpstream)
+	var generated string
+	poll := func() {
+		for _, provider := range providers {
+			upstreams, err := provider.Discover()
+			if err != nil {
+				ErrorLog(fmt.Errorf("discovery %s: %w", provider.Name(), err))
+				continue
+			}
+			var valid []DiscoveredUpstream
+			for _, upstream := range upstreams {
+				if _, err := ParseUpstream(upstream.Address); err != nil {
+					ErrorLog(fmt.Errorf("discovery %s: %w", provider.Name(), err))
+					continue
+				}
+				valid = append(valid, upstream)
+			}
+			results[provider.Name()] = valid
+		}
+
+		for _, host := range store.Static() {
+			for _, location := range host.Locations {
+				if location.Discover == "" {
+					continue
+				}
+				for _, provider := range providers {
+					location.Pool().SetDiscovered(provider.Name(), DiscoveredAddresses(results[provider.Name()], func(upstream DiscoveredUpstream) bool {
+						return upstream.Service == location.Discover
+					}))
+				}
+			}
+		}
+
+		hosts := DiscoveredHosts(store.Static(), results)
+		// Only replace the generated hosts when they change, to keep the state of their upstream pools
+		if summary := fmt.Sprint(hosts); summary != generated {
+			generated = summary
+			store.SetGenerated(GenerateHosts(hosts))
+		}
+	}
+
+	poll()
+	go func() {
+		for {
+			time.Sleep(DiscoveryInterval())
+			poll()
+		}
+	}()
+}
+
+// DiscoveredAddresses returns the sorted addresses of the upstreams matching the filter.
+func DiscoveredAddresses(upstreams []DiscoveredUpstream, filter func(DiscoveredUpstream) bool) []string {
+	var addresses []string
+	for _, upstream := range upstreams {
+		if filter(upstream) && !slices.Contains(addresses, upstream.Address) {
+			addresses = append(addresses, upstream.Address)
+		}
+	}
+	slices.Sort(addresses)
+	return addresses
+}
+
+// DiscoveredHosts returns the upstreams of each domain of the discovered upstreams that no host file matches.
+func DiscoveredHosts(static []Host, results map[string][]DiscoveredUpstream) map[string][]string {
+	var all []DiscoveredUpstream
+	for _, name := range slices.Sorted(maps.Keys(results)) {
+		all = append(all, results[name]...)
+	}
+	hosts := make(map[string][]string)
+	for _, upstream := range all {
+		domain := strings.ToLower(upstream.Host)
+		if domain == "" || hosts[domain] != nil || MatchHost(static, domain) != nil {
+			continue
+		}
+		hosts[domain] = DiscoveredAddresses(all, func(upstream DiscoveredUpstream) bool {
+			return strings.EqualFold(upstream.Host, domain)
+		})
+	}
+	return hosts
+}
+
+// GenerateHosts returns a host for each domain, proxying every request to the upstreams of the domain.
+func GenerateHosts(upstreams map[string][]string) []Host {
+	var hosts []Host
+	for _, domain := range slices.Sorted(maps.Keys(upstreams)) {
+		host := Host{
+			Domain:    domain,
+			Locations: []HostLocation{{Match: "*", Upstreams: upstreams[domain]}},
+		}
+		if err := PrepareHost(&host); err != nil {
+			ErrorLog(fmt.Errorf("discovery: host %s: %w", domain, err))
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// FileDiscovery reads upstreams from a JSON file, e.g. written by deployment tools. The file is read again when it
+// is modified. It contains a list of upstreams: [{"service": "api", "host": "api.example.com", "address": "..."}]
+type FileDiscovery struct {
+	Path string
+
+	modTime   time.Time
+	upstreams []DiscoveredUpstream
+}
+
+func (provider *FileDiscovery) Name() string {
+	return "file"
+}
+
+func (provider *FileDiscovery) Discover() ([]DiscoveredUpstream, error) {
+	info, err := os.Stat(provider.Path)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(provider.modTime) {
+		return provider.upstreams, nil
+	}
+	content, err := os.ReadFile(provider.Path)
+	if err != nil {
+		return nil, err
+	}
+	var upstreams []DiscoveredUpstream
+	if err := json.Unmarshal(content, &upstreams); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", provider.Path, err)
+	}
+	provider.modTime = info.ModTime()
+	provider.upstreams = upstreams
+	return upstreams, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSDiscoveryConfig adds the upstreams found by resolving a DNS name to the upstreams of a location. The name is
+// resolved again when the TTL of the records expires, within the min and max refresh intervals. If the resolution
+// fails, the previous upstreams are kept.
+type DNSDiscoveryConfig struct {
+	// Name to resolve, e.g. "app.internal" for A/AAAA records or "_http._tcp.app.internal" for SRV records.
+	Name string `yaml:"name"`
+	// Either "A" (A and AAAA records) or "SRV". Default is A.
+	Type string `yaml:"type,omitempty"`
+	// Port of the upstreams found with A/AAAA records. Default is 80, or 443 for https.
+	Port int `yaml:"port,omitempty"`
+	// Either "http" or "https". Default is http.
+	Scheme string `yaml:"scheme,omitempty"`
+	// Address of the DNS server, e.g. "10.0.0.2:53". Default is the first nameserver of /etc/resolv.conf.
+	Resolver string `yaml:"resolver,omitempty"`
+	// Minimum time between two resolutions, in seconds, whatever the TTL. Default is 5 seconds.
+	MinRefresh int `yaml:"min_refresh,omitempty"`
+	// Maximum time between two resolutions, in seconds, whatever the TTL. Default is 5 minutes.
+	MaxRefresh int `yaml:"max_refresh,omitempty"`
+}
+
+// ServiceName returns the name the discovered upstreams are known by: the name itself for A records, and the domain of
+// the service for SRV records, e.g. "app.internal" for "_https._tcp.app.internal", which is what the certificates of
+// the upstreams are expected to be issued for.
+func (discovery *DNSDiscoveryConfig) ServiceName() string {
+	name := strings.TrimSuffix(discovery.Name, ".")
+	if discovery.Type != "SRV" {
+		return name
+	}
+	for strings.HasPrefix(name, "_") {
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return name
+}
+
+// Validate checks the configuration and fills in the defaults.
+func (discovery *DNSDiscoveryConfig) Validate() error {
+	if discovery == nil {
+		return nil
+	}
+	if discovery.Name == "" {
+		return errors.New("dns discovery name is required")
+	}
+	discovery.Type = strings.ToUpper(discovery.Type)
+	if discovery.Type == "" {
+		discovery.Type = "A"
+	}
+	if discovery.Type != "A" && discovery.Type != "SRV" {
+		return fmt.Errorf("unsupported dns discovery type: %s", discovery.Type)
+	}
+	discovery.Scheme = strings.ToLower(discovery.Scheme)
+	if discovery.Scheme == "" {
+		discovery.Scheme = "http"
+	}
+	if discovery.Scheme != "http" && discovery.Scheme != "https" {
+		return fmt.Errorf("unsupported dns discovery scheme: %s", discovery.Scheme)
+	}
+	if discovery.Port == 0 {
+		discovery.Port = 80
+		if discovery.Scheme == "https" {
+			discovery.Port = 443
+		}
+	}
+	if discovery.Resolver == "" {
+		discovery.Resolver = SystemResolver()
+	} else if _, _, err := net.SplitHostPort(discovery.Resolver); err != nil {
+		discovery.Resolver = net.JoinHostPort(discovery.Resolver, "53")
+	}
+	return nil
+}
+
+func (discovery *DNSDiscoveryConfig) refreshInterval(ttl time.Duration) time.Duration {
+	minRefresh, maxRefresh := 5*time.Second, 5*time.Minute
+	if discovery.MinRefresh > 0 {
+		minRefresh = time.Duration(discovery.MinRefresh) * time.Second
+	}
+	if discovery.MaxRefresh > 0 {
+		maxRefresh = time.Duration(discovery.MaxRefresh) * time.Second
+	}
+	return min(max(ttl, minRefresh), max(maxRefresh, minRefresh))
+}
+
+// SystemResolver returns the address of the first nameserver in /etc/resolv.conf, or of a local resolver.
+func SystemResolver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// Resolve returns the upstream addresses currently published in DNS, and the TTL of the records.
+func (discovery *DNSDiscoveryConfig) Resolve() ([]string, time.Duration, error) {
+	if discovery.Type == "SRV" {
+		return discovery.resolveSRV()
+	}
+	ips, ttl, err := discovery.resolveIPs(discovery.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var upstreams []string
+	for _, ip := range ips {
+		upstreams = append(upstreams, discovery.Scheme+"://"+net.JoinHostPort(ip, strconv.Itoa(discovery.Port)))
+	}
+	return upstreams, ttl, nil
+}
+
+func (discovery *DNSDiscoveryConfig) resolveSRV() ([]string, time.Duration, error) {
+	answers, additionals, err := QueryDNS(discovery.Resolver, discovery.Name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := minTTL(answers)
+	var upstreams []string
+	for _, answer := range answers {
+		srv, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		target := srv.Target.String()
+		// Use the addresses sent with the answer if there are any, instead of another query
+		var ips []string
+		for _, additional := range additionals {
+			if !strings.EqualFold(additional.Header.Name.String(), target) {
+				continue
+			}
+			if ip := resourceIP(additional); ip != "" {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			var ipTTL time.Duration
+			ips, ipTTL, err = discovery.resolveIPs(target)
+			if err != nil {
+				return nil, 0, err
+			}
+			ttl = min(ttl, ipTTL)
+		}
+		for _, ip := range ips {
+			upstreams = append(upstreams, discovery.Scheme+"://"+net.JoinHostPort(ip, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return upstreams, ttl, nil
+}
+
+func (discovery *DNSDiscoveryConfig) resolveIPs(name string) ([]string, time.Duration, error) {
+	var ips []string
+	var resources []dnsmessage.Resource
+	var lastErr error
+	for _, recordType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, _, err := QueryDNS(discovery.Resolver, name, recordType)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range answers {
+			if ip := resourceIP(answer); ip != "" {
+				ips = append(ips, ip)
+				resources = append(resources, answer)
+			}
+		}
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return ips, minTTL(resources), nil
+}
+
+func resourceIP(resource dnsmessage.Resource) string {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:]).String()
+	}
+	return ""
+}
+
+func minTTL(resources []dnsmessage.Resource) time.Duration {
+	if len(resources) == 0 {
+		return 0
+	}
+	ttl := resources[0].Header.TTL
+	for _, resource := range resources[1:] {
+		ttl = min(ttl, resource.Header.TTL)
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// QueryDNS sends a query to the DNS server over UDP, or over TCP if the response is truncated. It returns the answer
+// and additional records of the response.
+func QueryDNS(server, name string, recordType dnsmessage.Type) ([]dnsmessage.Resource, []dnsmessage.Resource, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	queryName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: queryName, Type: recordType, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := exchangeDNS("udp", server, packed)
+	if err == nil && response.Header.Truncated {
+		response, err = exchangeDNS("tcp", server, packed)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.Header.ID != id {
+		return nil, nil, errors.New("DNS response does not match the query")
+	}
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil, fmt.Errorf("DNS name not found: %s", name)
+	default:
+		return nil, nil, fmt.Errorf("DNS query for %s failed: %s", name, response.Header.RCode)
+	}
+	return response.Answers, response.Additionals, nil
+}
+
+func exchangeDNS(network, server string, query []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, server, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var buf []byte
+	if network == "tcp" {
+		// DNS over TCP prefixes messages with their length
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// StartDNSDiscovery resolves the upstreams of the pool in the background and keeps them up to date until stop is
+// closed. The pool has no upstreams from DNS until the first resolution completes, so that unreachable resolvers don't
+// delay startup.
+func StartDNSDiscovery(discovery *DNSDiscoveryConfig, pool *UpstreamPool, stop <-chan struct{}) {
+	refresh := func() time.Duration {
+		discovered, ttl, err := discovery.Resolve()
+		if err == nil && len(discovered) == 0 {
+			err = fmt.Errorf("no records found for %s", discovery.Name)
+		}
+		if err != nil {
+			// Keep the previous upstreams
+			ErrorLog(fmt.Errorf("dns discovery: %w", err))
+			return discovery.refreshInterval(0)
+		}
+		slices.Sort(discovered)
+		pool.SetDiscovered("dns", discovered)
+		return discovery.refreshInterval(ttl)
+	}
+
+	go func() {
+		for {
+			next := refresh()
+			select {
+			case <-stop:
+				return
+			case <-time.After(next):
+			}
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DockerDiscovery finds upstreams in the labels of running containers, using the Docker Engine API over its Unix
+// socket. Containers are discovered when they have an "iridium.host" or "iridium.service" label:
+//   - iridium.host: domain of the host generated for the container
+//   - iridium.service: service the container belongs to, see HostLocation.Discover
+//   - iridium.port: port of the container receiving requests, if it exposes several ports
+//   - iridium.scheme: either "http" or "https". Default is http.
+//   - iridium.network: network used to reach the container, if it is connected to several networks
+type DockerDiscovery struct {
+	Socket string
+
+	client *http.Client
+	// Errors of the previous poll, only logged when they first occur
+	reported []string
+}
+
+func NewDockerDiscovery(socket string) *DockerDiscovery {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &DockerDiscovery{
+		Socket: socket,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (provider *DockerDiscovery) Name() string {
+	return "docker"
+}
+
+// dockerContainer is the part of the container list returned by the Docker Engine API that is used for discovery.
+type dockerContainer struct {
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		IP          string `json:"IP"`
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (provider *DockerDiscovery) Discover() ([]DiscoveredUpstream, error) {
+	// The host in the URL is ignored, requests are sent to the socket
+	response, err := provider.client.Get("http://docker/containers/json?filters=" + url.QueryEscape(`{"status":["running"]}`))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker API returned status %d", response.StatusCode)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(response.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to parse docker containers: %v", err)
+	}
+
+	var upstreams []DiscoveredUpstream
+	var reported []string
+	for _, container := range containers {
+		host, service := container.Labels["iridium.host"], container.Labels["iridium.service"]
+		if host == "" && service == "" {
+			continue
+		}
+		address, err := container.upstreamAddress()
+		if err != nil {
+			name := strings.TrimPrefix(strings.Join(container.Names, ","), "/")
+			message := fmt.Sprintf("discovery docker: container %s: %v", name, err)
+			if !slices.Contains(provider.reported, message) {
+				ErrorLog(errors.New(message))
+			}
+			reported = append(reported, message)
+			continue
+		}
+		upstreams = append(upstreams, DiscoveredUpstream{Service: service, Host: host, Address: address})
+	}
+	provider.reported = reported
+	return upstreams, nil
+}
+
+// upstreamAddress returns the address of the container on its network, or its published port if it has no address,
+// e.g. when it uses the host network.
+func (container dockerContainer) upstreamAddress() (string, error) {
+	scheme := container.Labels["iridium.scheme"]
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	port := 0
+	if label := container.Labels["iridium.port"]; label != "" {
+		var err error
+		if port, err = strconv.Atoi(label); err != nil {
+			return "", fmt.Errorf("invalid iridium.port label: %s", label)
+		}
+	} else {
+		var exposed []int
+		for _, p := range container.Ports {
+			if p.Type == "tcp" && !slices.Contains(exposed, p.PrivatePort) {
+				exposed = append(exposed, p.PrivatePort)
+			}
+		}
+		if len(exposed) != 1 {
+			return "", fmt.Errorf("%d exposed ports, set the iridium.port label", len(exposed))
+		}
+		port = exposed[0]
+	}
+
+	ip := ""
+	if network := container.Labels["iridium.network"]; network != "" {
+		ip = container.NetworkSettings.Networks[network].IPAddress
+	} else {
+		for _, name := range slices.Sorted(maps.Keys(container.NetworkSettings.Networks)) {
+			if address := container.NetworkSettings.Networks[name].IPAddress; address != "" {
+				ip = address
+				break
+			}
+		}
+	}
+	if ip != "" {
+		return scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port)), nil
+	}
+
+	for _, p := range container.Ports {
+		if p.PrivatePort == port && p.PublicPort != 0 {
+			return scheme + "://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(p.PublicPort)), nil
+		}
+	}
+	return "", fmt.Errorf("no address found for port %d", port)
+}
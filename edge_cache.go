@@ -12,6 +12,8 @@ type EdgeCacheFile struct {
 	AddedAt  time.Time
 	Path     string
 	Headers  map[string]string
+	// Content encoding of Data, if it is stored compressed.
+	Encoding string
 }
 
 // edgeCacheIgnoredHeaders are headers that should not be cached or forwarded to clients when serving from edge cache
@@ -52,6 +54,7 @@ func GetFileFromEdgeCache(key string) (*EdgeCacheFile, bool) {
 				Duration: data.Duration,
 				AddedAt:  data.AddedAt,
 				Headers:  edgeCacheHeaders[key],
+				Encoding: data.Encoding,
 			}, true
 		}
 		// Cache expired, remove it
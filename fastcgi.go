@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FastCGI record types and roles, as defined by the FastCGI specification.
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiMaxContent   = 65535
+)
+
+// DefaultSplitPathInfo splits "/index.php/users" into the script "/index.php" and the path info "/users".
+const DefaultSplitPathInfo = `^(.+?\.php)(/.*)$`
+
+type FastCGIConfig struct {
+	// Address of the FastCGI server, e.g. "127.0.0.1:9000" or "unix:/run/php/php-fpm.sock".
+	Address string `yaml:"address"`
+	// Directory containing the scripts, as seen by the FastCGI server. Used to build SCRIPT_FILENAME.
+	Root string `yaml:"root"`
+	// Script used for paths ending with "/". Default is "index.php".
+	Index string `yaml:"index,omitempty"`
+	// Regex splitting the path into the script name and the path info, with two capture groups.
+	// Default is `^(.+?\.php)(/.*)$`.
+	SplitPathInfo string `yaml:"split_path_info,omitempty"`
+	// Additional parameters sent to the FastCGI server, e.g. {"APP_ENV": "production"}. Values can contain variables.
+	Params map[string]string `yaml:"params,omitempty"`
+
+	splitPathInfo *regexp.Regexp
+}
+
+// Compile validates the configuration and compiles the split path info regex.
+func (config *FastCGIConfig) Compile() error {
+	if config == nil {
+		return nil
+	}
+	if config.Address == "" {
+		return errors.New("fastcgi address is required")
+	}
+	if config.Root == "" {
+		return errors.New("fastcgi root is required")
+	}
+	split := config.SplitPathInfo
+	if split == "" {
+		split = DefaultSplitPathInfo
+	}
+	regex, err := regexp.Compile(split)
+	if err != nil {
+		return fmt.Errorf("invalid fastcgi split_path_info: %v", err)
+	}
+	if regex.NumSubexp() < 2 {
+		return errors.New("fastcgi split_path_info must have two capture groups")
+	}
+	config.splitPathInfo = regex
+	return nil
+}
+
+// FastCGIParams builds the CGI parameters of a request.
+func (config *FastCGIConfig) FastCGIParams(request HttpRequest, location HostLocation) (map[string]string, error) {
+	rawPath, query, _ := strings.Cut(request.Path, "?")
+	requestPath, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	requestPath = path.Clean("/" + requestPath)
+	if strings.HasSuffix(rawPath, "/") && requestPath != "/" {
+		requestPath += "/"
+	}
+
+	scriptName, pathInfo := requestPath, ""
+	if strings.HasSuffix(scriptName, "/") {
+		index := config.Index
+		if index == "" {
+			index = "index.php"
+		}
+		scriptName += index
+	}
+	split := config.splitPathInfo
+	if split == nil {
+		split = regexp.MustCompile(DefaultSplitPathInfo)
+	}
+	if match := split.FindStringSubmatch(requestPath); match != nil {
+		scriptName, pathInfo = match[1], match[2]
+	}
+
+	serverName := request.Headers["host"]
+	if hostname, _, err := net.SplitHostPort(serverName); err == nil {
+		serverName = hostname
+	}
+	serverAddr, serverPort, _ := net.SplitHostPort(request.LocalAddr)
+	remotePort := ""
+	if addr := parseTCPAddr(request.RemoteAddr); addr != nil && addr.IP.String() == request.ClientIP {
+		remotePort = strconv.Itoa(addr.Port)
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "Iridium/" + VERSION,
+		"SERVER_PROTOCOL":   request.Version,
+		"SERVER_NAME":       serverName,
+		"SERVER_ADDR":       serverAddr,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_METHOD":    request.Method,
+		"REQUEST_SCHEME":    request.Scheme,
+		"REQUEST_URI":       request.Path,
+		"DOCUMENT_URI":      requestPath,
+		"DOCUMENT_ROOT":     config.Root,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   filepath.Join(config.Root, filepath.FromSlash(scriptName)),
+		"PATH_INFO":         pathInfo,
+		"QUERY_STRING":      query,
+		"REMOTE_ADDR":       request.ClientIP,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      request.Headers["content-type"],
+		"CONTENT_LENGTH":    strconv.FormatInt(request.BodyLength(), 10),
+		// Required by PHP when cgi.force_redirect is enabled
+		"REDIRECT_STATUS": "200",
+	}
+	if pathInfo != "" {
+		params["PATH_TRANSLATED"] = filepath.Join(config.Root, filepath.FromSlash(pathInfo))
+	}
+	if request.Scheme == "https" {
+		params["HTTPS"] = "on"
+	}
+	for k, v := range request.Headers {
+		k = strings.ToLower(k)
+		if k == "content-type" || k == "content-length" || k == "proxy" {
+			// Proxy is skipped to protect scripts from "httpoxy" attacks
+			continue
+		}
+		params["HTTP_"+strings.ToUpper(strings.ReplaceAll(k, "-", "_"))] = v
+	}
+	variables := RequestVariables(request, location)
+	for k, v := range config.Params {
+		params[k] = ExpandVariables(v, variables)
+	}
+	return params, nil
+}
+
+// MakeFastCGIRequest sends the request to the FastCGI server of the location and returns its response.
+// On failure, it also returns the kind of failure (see ProxyFailureKind).
+func MakeFastCGIRequest(request HttpRequest, location HostLocation) (HttpRequest, string, error) {
+	config := location.FastCGI
+	params, err := config.FastCGIParams(request, location)
+	if err != nil {
+		return HttpRequest{}, "", err
+	}
+
+	address := config.Address
+	if !strings.HasPrefix(address, "unix:") && !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	target, err := ParseUpstream(address)
+	if err != nil {
+		return HttpRequest{}, RetryOnConnectFailure, err
+	}
+	dialed, err := DialTarget(target, nil, nil, location.Timeouts.ConnectTimeout())
+	if err != nil {
+		return HttpRequest{}, ProxyFailureKind(err, false), err
+	}
+	defer dialed.Close()
+	conn := &UpstreamConn{
+		Conn:             dialed,
+		SendTimeout:      location.Timeouts.SendTimeout(),
+		FirstByteTimeout: location.Timeouts.FirstByteTimeout(),
+		IdleTimeout:      location.Timeouts.IdleReadTimeout(),
+	}
+
+	var out bytes.Buffer
+	writeFastCGIRecord(&out, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0})
+	writeFastCGIStream(&out, fcgiParams, encodeFastCGIParams(params))
+	if request.BodySource == nil {
+		writeFastCGIStream(&out, fcgiStdin, []byte(request.Body))
+	}
+	if _, err := conn.Write(out.Bytes()); err != nil {
+		return HttpRequest{}, ProxyFailureKind(err, true), err
+	}
+	if request.BodySource != nil {
+		if err := writeFastCGIBody(conn, request.BodySource); err != nil {
+			return HttpRequest{}, ProxyFailureKind(err, true), err
+		}
+	}
+
+	stdout, err := readFastCGIResponse(conn)
+	if err != nil {
+		return HttpRequest{}, ProxyFailureKind(err, true), err
+	}
+	response, err := parseCGIResponse(stdout)
+	if err != nil {
+		return HttpRequest{}, "", err
+	}
+	response.Method = request.Method
+	response.Path = request.Path
+	response.Version = request.Version
+	return response, "", nil
+}
+
+func writeFastCGIRecord(w *bytes.Buffer, recordType byte, content []byte) {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{fcgiVersion, recordType, 0, 1, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	w.Write(header)
+	w.Write(content)
+	w.Write(make([]byte, padding))
+}
+
+// writeFastCGIStream writes the content as a stream of records, terminated by an empty record.
+func writeFastCGIStream(w *bytes.Buffer, recordType byte, content []byte) {
+	for len(content) > 0 {
+		n := min(len(content), fcgiMaxContent)
+		writeFastCGIRecord(w, recordType, content[:n])
+		content = content[n:]
+	}
+	writeFastCGIRecord(w, recordType, nil)
+}
+
+// writeFastCGIBody sends a request body that is not held in memory as the stdin stream, one record at a time.
+func writeFastCGIBody(conn net.Conn, body *RequestBody) error {
+	reader, err := body.Reader()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, fcgiMaxContent)
+	var record bytes.Buffer
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			record.Reset()
+			writeFastCGIRecord(&record, fcgiStdin, buf[:n])
+			if _, err := conn.Write(record.Bytes()); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	record.Reset()
+	writeFastCGIRecord(&record, fcgiStdin, nil)
+	_, err = conn.Write(record.Bytes())
+	return err
+}
+
+func encodeFastCGIParams(params map[string]string) []byte {
+	var buf bytes.Buffer
+	writeLength := func(n int) {
+		if n < 128 {
+			buf.WriteByte(byte(n))
+			return
+		}
+		_ = binary.Write(&buf, binary.BigEndian, uint32(n)|1<<31)
+	}
+	for k, v := range params {
+		writeLength(len(k))
+		writeLength(len(v))
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+// readFastCGIResponse reads records until the end of the request, and returns the content of the stdout stream.
+// The stderr stream is written to the error log.
+func readFastCGIResponse(conn net.Conn) ([]byte, error) {
+	reader := bufio.NewReader(conn)
+	var stdout, stderr bytes.Buffer
+	defer func() {
+		if stderr.Len() > 0 {
+			ErrorLog(fmt.Errorf("fastcgi: %s", strings.TrimSpace(stderr.String())))
+		}
+	}()
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		content := make([]byte, length+int(header[6]))
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return nil, err
+		}
+		content = content[:length]
+		switch header[1] {
+		case fcgiStdout:
+			stdout.Write(content)
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			return stdout.Bytes(), nil
+		}
+	}
+}
+
+// parseCGIResponse parses the headers and body written by a CGI script. The status is read from the "Status" header.
+func parseCGIResponse(data []byte) (HttpRequest, error) {
+	response := HttpRequest{Status: 200, Headers: make(map[string]string)}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return response, fmt.Errorf("malformed fastcgi response: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if name == "status" {
+			code, _, _ := strings.Cut(value, " ")
+			status, err := strconv.Atoi(code)
+			if err != nil || status < 100 || status > 599 {
+				return response, fmt.Errorf("invalid fastcgi status: %s", value)
+			}
+			response.Status = status
+			continue
+		}
+		AppendHeader(response.Headers, name, value)
+	}
+	if _, ok := response.Headers["location"]; ok && response.Status == 200 {
+		response.Status = 302
+	}
+	body, _ := io.ReadAll(reader)
+	response.Body = string(body)
+	return response, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// trustedProxies are the networks of "server.trusted_proxies", loaded at startup by LoadTrustedProxies.
+var trustedProxies []*net.IPNet
+
+// ParseCIDRList parses a list of CIDR ranges or single IP addresses.
+func ParseCIDRList(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR range: %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR range: %s", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// IsIPInList reports whether the IP address is contained in one of the networks.
+func IsIPInList(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadTrustedProxies parses "server.trusted_proxies" once, so that requests don't parse it again.
+func LoadTrustedProxies() error {
+	networks, err := ParseCIDRList(GetConfigStringList("server.trusted_proxies"))
+	if err != nil {
+		return fmt.Errorf("server.trusted_proxies: %v", err)
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// TrustedProxies returns the networks from "server.trusted_proxies" whose forwarding headers are believed.
+func TrustedProxies() []*net.IPNet {
+	return trustedProxies
+}
+
+// ResolveClientIP returns the IP address of the client that sent the request. Forwarding headers are only used when the
+// peer is a trusted proxy, in which case the chain is walked from right to left until an untrusted address is found.
+func ResolveClientIP(peerIP string, headers map[string]string) string {
+	trusted := TrustedProxies()
+	if !IsIPInList(peerIP, trusted) {
+		return peerIP
+	}
+
+	var chain []string
+	if xff := headers["x-forwarded-for"]; xff != "" {
+		for _, ip := range strings.Split(xff, ",") {
+			chain = append(chain, strings.TrimSpace(ip))
+		}
+	} else if forwarded := headers["forwarded"]; forwarded != "" {
+		chain = ParseForwardedFor(forwarded)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			// Obfuscated or unknown identifiers can't be trusted any further
+			break
+		}
+		if !IsIPInList(chain[i], trusted) || i == 0 {
+			return chain[i]
+		}
+	}
+	return peerIP
+}
+
+// ParseForwardedFor returns the "for" parameters of an RFC 7239 Forwarded header, without quotes and ports.
+func ParseForwardedFor(header string) []string {
+	var nodes []string
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(parts) != 2 || !strings.EqualFold(parts[0], "for") {
+				continue
+			}
+			node := strings.Trim(parts[1], `"`)
+			if strings.HasPrefix(node, "[") {
+				// IPv6 address, optionally followed by a port
+				if end := strings.Index(node, "]"); end != -1 {
+					node = node[1:end]
+				}
+			} else if host, _, err := net.SplitHostPort(node); err == nil {
+				node = host
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// formatForwardedNode formats an IP address as a node of an RFC 7239 Forwarded header.
+func formatForwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// SetForwardingHeaders sets the X-Forwarded-* and Forwarded headers of a request sent upstream.
+// The peer address is appended to the existing chains, which are only kept if the peer is a trusted proxy.
+func SetForwardingHeaders(headers map[string]string, request HttpRequest) {
+	peerIP := GetLocalIpWithoutPort(request.RemoteAddr)
+	peerTrusted := IsIPInList(peerIP, TrustedProxies())
+	host := request.Headers["host"]
+
+	xff := request.Headers["x-forwarded-for"]
+	if xff != "" && peerTrusted {
+		headers["x-forwarded-for"] = xff + ", " + peerIP
+	} else {
+		headers["x-forwarded-for"] = peerIP
+	}
+
+	headers["x-forwarded-proto"] = request.Scheme
+	if proto := request.Headers["x-forwarded-proto"]; proto != "" && peerTrusted {
+		headers["x-forwarded-proto"] = proto
+	}
+	headers["x-forwarded-host"] = host
+	if forwardedHost := request.Headers["x-forwarded-host"]; forwardedHost != "" && peerTrusted {
+		headers["x-forwarded-host"] = forwardedHost
+	}
+
+	element := "for=" + formatForwardedNode(peerIP) + ";proto=" + request.Scheme
+	if host != "" {
+		element += `;host="` + host + `"`
+	}
+	if forwarded := request.Headers["forwarded"]; forwarded != "" && peerTrusted {
+		headers["forwarded"] = forwarded + ", " + element
+	} else {
+		headers["forwarded"] = element
+	}
+}
@@ -14,3 +14,45 @@ func PopulateHeaders(headers ...*map[string]string) map[string]string {
 	}
 	return result
 }
+
+// AppendHeader adds a value to a header, keeping its existing values. Set-Cookie values are separated by newlines since
+// they can't be combined, and are sent as separate header lines. Other values are separated by commas.
+func AppendHeader(headers map[string]string, key, value string) {
+	key = strings.TrimSpace(strings.ToLower(key))
+	existing, ok := headers[key]
+	if !ok || existing == "" {
+		headers[key] = value
+	} else if key == "set-cookie" {
+		headers[key] = existing + "\n" + value
+	} else {
+		headers[key] = existing + ", " + value
+	}
+}
+
+// HeaderRules describes changes made to the headers of a request or response.
+// Values can use variables such as $client_ip or $request_id, or ${host} when followed by a letter or "_" (see
+// RequestVariables).
+type HeaderRules struct {
+	// Headers to set, replacing any existing value.
+	Set map[string]string `yaml:"set,omitempty"`
+	// Headers to add, keeping any existing value.
+	Add map[string]string `yaml:"add,omitempty"`
+	// Headers to remove.
+	Remove []string `yaml:"remove,omitempty"`
+}
+
+// Apply applies the rules to the headers, in this order: remove, set, add.
+func (rules *HeaderRules) Apply(headers map[string]string, variables map[string]string) {
+	if rules == nil {
+		return
+	}
+	for _, k := range rules.Remove {
+		delete(headers, strings.TrimSpace(strings.ToLower(k)))
+	}
+	for k, v := range rules.Set {
+		headers[strings.TrimSpace(strings.ToLower(k))] = ExpandVariables(v, variables)
+	}
+	for k, v := range rules.Add {
+		AppendHeader(headers, k, ExpandVariables(v, variables))
+	}
+}
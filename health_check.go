@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// HealthCheckConfig actively checks the upstreams of a TCP stream by connecting to them. Upstreams failing the check
+// are skipped until a check succeeds again. Without health checks, upstreams are only skipped for
+// UpstreamFailureCooldown after a connection to them failed.
+type HealthCheckConfig struct {
+	// Time between two checks of each upstream, in seconds. Default is 10 seconds.
+	Interval int `yaml:"interval,omitempty"`
+	// Time allowed to connect to an upstream, in seconds. Default is 3 seconds.
+	Timeout int `yaml:"timeout,omitempty"`
+}
+
+func (check *HealthCheckConfig) interval() time.Duration {
+	if check.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(check.Interval) * time.Second
+}
+
+func (check *HealthCheckConfig) timeout() time.Duration {
+	if check.Timeout <= 0 {
+		return 3 * time.Second
+	}
+	return time.Duration(check.Timeout) * time.Second
+}
+
+// StartHealthChecks checks the members of the pool in the background until stop is closed. Changes of the health of
+// an upstream are logged. A nil config does nothing.
+func StartHealthChecks(name string, pool *UpstreamPool, check *HealthCheckConfig, stop <-chan struct{}) {
+	if check == nil {
+		return
+	}
+	down := make(map[string]bool)
+	go func() {
+		for {
+			for _, upstream := range pool.Members() {
+				network, address := "tcp", upstream
+				if socketPath, found := strings.CutPrefix(upstream, "unix:"); found {
+					network, address = "unix", socketPath
+				}
+				conn, err := net.DialTimeout(network, address, check.timeout())
+				if err != nil {
+					// Unhealthy until the next check, at least
+					MarkUpstreamDown(upstream, check.interval()+check.timeout())
+					if !down[upstream] {
+						ErrorLog(fmt.Errorf("health check %s: upstream %s is down: %v", name, upstream, err))
+					}
+					down[upstream] = true
+					continue
+				}
+				conn.Close()
+				MarkUpstreamHealthy(upstream)
+				if down[upstream] {
+					AppendLog("INFO", fmt.Sprintf("Health check %s: upstream %s is up", name, upstream))
+				}
+				delete(down, upstream)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(check.interval()):
+			}
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// serverNames are the compiled server names of a host, see Host.ServerNames.
+type serverNames struct {
+	exact []string
+	// Suffixes matched by leading wildcards, e.g. ".example.com" for "*.example.com"
+	wildcards []string
+	regexes   []*regexp.Regexp
+}
+
+// NormalizeHostname returns the hostname of a Host header or server name, in lowercase, without port or trailing dot,
+// and with international domain names converted to punycode, e.g. "Bücher.Example:8080" becomes
+// "xn--bcher-kva.example".
+func NormalizeHostname(host string) string {
+	host = strings.TrimSpace(host)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return strings.ToLower(host)
+}
+
+// ServerNames returns every name the host answers to: Domain, followed by Domains.
+func (host *Host) ServerNames() []string {
+	var names []string
+	if host.Domain != "" {
+		names = append(names, host.Domain)
+	}
+	return append(names, host.Domains...)
+}
+
+// compileServerNames validates the server names of the host and compiles its wildcards and regexes.
+func (host *Host) compileServerNames() error {
+	names := host.ServerNames()
+	if len(names) == 0 && !host.Default {
+		return errors.New("domain is required")
+	}
+	var compiled serverNames
+	for _, name := range names {
+		if pattern, ok := strings.CutPrefix(name, "~"); ok {
+			regex, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				return fmt.Errorf("invalid server name regex %s: %v", pattern, err)
+			}
+			compiled.regexes = append(compiled.regexes, regex)
+		} else if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			if strings.Contains(suffix, "*") {
+				return fmt.Errorf("invalid wildcard server name: %s", name)
+			}
+			compiled.wildcards = append(compiled.wildcards, "."+NormalizeHostname(suffix))
+		} else {
+			if strings.Contains(name, "*") {
+				return fmt.Errorf("only leading wildcards are supported: %s", name)
+			}
+			compiled.exact = append(compiled.exact, NormalizeHostname(name))
+		}
+	}
+	host.serverNames = compiled
+	return nil
+}
+
+// MatchHost returns the host answering to the given name, or nil if there is none. Exact names take precedence over
+// wildcards, then the longest wildcard takes precedence over shorter ones, and regexes are tried last, in order.
+func MatchHost(hosts []Host, name string) *Host {
+	name = NormalizeHostname(name)
+	for i := range hosts {
+		for _, exact := range hosts[i].serverNames.exact {
+			if exact == name {
+				return &hosts[i]
+			}
+		}
+	}
+	var matched *Host
+	longest := 0
+	for i := range hosts {
+		for _, suffix := range hosts[i].serverNames.wildcards {
+			if strings.HasSuffix(name, suffix) && len(suffix) > longest {
+				matched, longest = &hosts[i], len(suffix)
+			}
+		}
+	}
+	if matched != nil {
+		return matched
+	}
+	for i := range hosts {
+		for _, regex := range hosts[i].serverNames.regexes {
+			if regex.MatchString(name) {
+				return &hosts[i]
+			}
+		}
+	}
+	return nil
+}
+
+// FindHost returns the host answering to the given name, or the default host if no host does.
+func FindHost(hosts []Host, name string) *Host {
+	if host := MatchHost(hosts, name); host != nil {
+		return host
+	}
+	for i := range hosts {
+		if hosts[i].Default {
+			return &hosts[i]
+		}
+	}
+	return nil
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http/httputil"
+	"net/netip"
+	"net/url"
 	"slices"
 	"strconv"
 	"strings"
@@ -15,15 +18,21 @@ import (
 )
 
 var ClientIgnoredHeaders = []string{
-	"x-forwarded-for", "host",
+	"x-forwarded-for", "x-forwarded-proto", "x-forwarded-host", "forwarded", "host",
 }
 var ServerIgnoredHeaders = []string{
 	"content-encoding", "content-length", "transfer-encoding", "connection", "keep-alive", "alt-svc", "server",
 	"content-type", "date", "vary",
 }
 
+// GatewayTimeout is the default timeout of each step of a proxied request (see ProxyTimeouts).
+const GatewayTimeout = 90 * time.Second
+
 // GetLocalIpWithoutPort extracts the IP address from a given address string, removing the port if present.
 func GetLocalIpWithoutPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
 	split := strings.Split(addr, ":")
 	if len(split) < 2 {
 		return addr
@@ -31,57 +40,120 @@ func GetLocalIpWithoutPort(addr string) string {
 	return strings.TrimSuffix(addr, ":"+split[len(split)-1])
 }
 
-// DialTarget tries to connect to the target host using TLS first, and falls back to plain TCP if TLS fails due to the target not supporting it.
-func DialTarget(targetHost string) (net.Conn, error) {
-	// Timeout after 90 seconds
-	gatewayTimeout := 90 * time.Second
-	dialer := &net.Dialer{Timeout: gatewayTimeout}
-	tlsConn, err := tls.DialWithDialer(dialer, "tcp", targetHost, &tls.Config{})
-	if err == nil {
-		_ = tlsConn.SetDeadline(time.Now().Add(gatewayTimeout))
-		return tlsConn, nil
-	}
+// UpstreamTarget is a parsed upstream address.
+type UpstreamTarget struct {
+	// Either "http", "https" or "unix".
+	Scheme string
+	// Address to connect to, in host:port form, or the path of the socket for Unix domain socket upstreams.
+	Address string
+	// Hostname of the upstream, without the port.
+	Hostname string
+	// Path prepended to the path of proxied requests, e.g. "/app" for "http://backend/app".
+	BasePath string
+}
 
-	// Fallback to plain TCP if TLS handshake fails
-	if strings.Contains(err.Error(), "first record does not look like a TLS handshake") {
-		conn, err := dialer.Dial("tcp", targetHost)
-		if err != nil {
-			return nil, err
+// ParseUpstream parses an upstream address such as "https://backend:8443/base" or "http://[2001:db8::1]:8080". The
+// scheme is required, so that upstreams are never sent plain HTTP when they expect TLS.
+// Unix domain sockets are written as "unix:/run/app.sock", optionally followed by a base path: "unix:/run/app.sock:/base".
+func ParseUpstream(address string) (UpstreamTarget, error) {
+	var target UpstreamTarget
+	if strings.HasPrefix(address, "unix:") {
+		target.Scheme = "unix"
+		target.Hostname = "localhost"
+		target.Address = strings.TrimPrefix(address, "unix:")
+		if socketPath, basePath, found := strings.Cut(target.Address, ":"); found {
+			target.Address = socketPath
+			target.BasePath = strings.TrimSuffix(basePath, "/")
 		}
-		_ = conn.SetDeadline(time.Now().Add(gatewayTimeout))
-		return conn, nil
+		if target.Address == "" {
+			return target, fmt.Errorf("invalid upstream address: %s", address)
+		}
+		return target, nil
 	}
-
-	return nil, err
+	if !strings.Contains(address, "://") {
+		return target, fmt.Errorf("upstream address %s has no scheme, use http:// or https://", address)
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return target, fmt.Errorf("invalid upstream address %s: %v", address, err)
+	}
+	target.Scheme = strings.ToLower(parsed.Scheme)
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return target, fmt.Errorf("unsupported upstream scheme: %s", target.Scheme)
+	}
+	if parsed.Hostname() == "" || parsed.User != nil || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return target, fmt.Errorf("invalid upstream address: %s", address)
+	}
+	if strings.Count(parsed.Host, ":") > 1 && !strings.HasPrefix(parsed.Host, "[") {
+		return target, fmt.Errorf("IPv6 upstream addresses must be in brackets: %s", address)
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return target, fmt.Errorf("invalid upstream port: %s", address)
+	}
+	target.Hostname = parsed.Hostname()
+	target.Address = net.JoinHostPort(target.Hostname, port)
+	target.BasePath = strings.TrimSuffix(parsed.EscapedPath(), "/")
+	return target, nil
 }
 
-func FormatTargetHost(host string) string {
-	if strings.Contains(host, "://") { // Remove scheme if present
-		parts := strings.SplitN(host, "://", 2)
-		host = parts[1]
-	} else if strings.Contains(host, "/") { // Remove any path components
-		parts := strings.SplitN(host, "/", 2)
-		host = parts[0]
-	} else if strings.Contains(host, ":/") { // Handle malformed scheme
-		parts := strings.SplitN(host, ":/", 2)
-		host = parts[1]
+// HostHeader returns the hostname of the upstream as written in a Host header or URL, with brackets for IPv6
+// addresses.
+func (target UpstreamTarget) HostHeader() string {
+	if strings.Contains(target.Hostname, ":") {
+		return "[" + target.Hostname + "]"
 	}
+	return target.Hostname
+}
 
-	if strings.Contains(host, ":") {
-		// If host includes a port, validate the port number
-		parts := strings.SplitN(host, ":", 2)
-		port := parts[1]
-		if portNum, err := strconv.Atoi(port); err != nil || portNum < 1 || portNum > 65535 {
-			return parts[0] // Invalid port, return only hostname
+// DialTarget connects to the upstream target. HTTPS targets are connected to using the given TLS config, and are never
+// downgraded to plain TCP. If proxyHeader is set, it is sent before anything else (including the TLS handshake).
+// Unix domain socket targets never use TLS. Connecting, including the TLS handshake, must complete within the given timeout.
+func DialTarget(target UpstreamTarget, tlsConfig *tls.Config, proxyHeader []byte, timeout time.Duration) (net.Conn, error) {
+	network := "tcp"
+	if target.Scheme == "unix" {
+		network = "unix"
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial(network, target.Address)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if len(proxyHeader) > 0 {
+		if _, err := conn.Write(proxyHeader); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send PROXY protocol header to %s: %w", target.Address, err)
 		}
-		return host // Valid host:port
+	}
+	if target.Scheme != "https" {
+		return conn, nil
 	}
 
-	return host // Host without port
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = target.Hostname
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", target.Address, err)
+	}
+	return tlsConn, nil
 }
 
-// MakeProxyRequest constructs and sends a proxied HTTP request to the target host, then reads and serves the response back to the client.
-func MakeProxyRequest(conn net.Conn, request HttpRequest, targetHost string) (*HttpRequest, error) {
+// MakeProxyRequest constructs and sends a proxied HTTP request to the upstreams of the location, retrying according to
+// its retry policy. If every attempt fails, an error response is served to the client.
+func MakeProxyRequest(conn net.Conn, request HttpRequest, location HostLocation) (*HttpRequest, error) {
 	proxyRequest := HttpRequest{
 		Method:  request.Method,
 		Body:    request.Body,
@@ -89,6 +161,12 @@ func MakeProxyRequest(conn net.Conn, request HttpRequest, targetHost string) (*H
 		Path:    request.Path,
 		Version: request.Version,
 		Status:  200,
+
+		RemoteAddr: request.RemoteAddr,
+		LocalAddr:  request.LocalAddr,
+		ClientIP:   request.ClientIP,
+		Scheme:     request.Scheme,
+		BodySource: request.BodySource,
 	}
 	for k, v := range request.Headers {
 		k = strings.TrimSpace(strings.ToLower(k))
@@ -96,63 +174,255 @@ func MakeProxyRequest(conn net.Conn, request HttpRequest, targetHost string) (*H
 			proxyRequest.Headers[k] = v
 		}
 	}
-
-	// Ensure "Host" header is set correctly
-	if strings.Contains(targetHost, ":") {
-		// If targetHost includes a port, extract just the hostname part for the Host header
-		proxyRequest.Headers["host"] = GetLocalIpWithoutPort(targetHost)
-	} else {
-		proxyRequest.Headers["host"] = targetHost
-		// Default to port 80 if no port is specified
-		targetHost = targetHost + ":80"
+	// The body was decoded, it is sent with its length, or chunked again if it is streamed with an unknown length
+	_, hasLength := request.Headers["content-length"]
+	_, hasEncoding := request.Headers["transfer-encoding"]
+	delete(proxyRequest.Headers, "content-length")
+	delete(proxyRequest.Headers, "transfer-encoding")
+	if length := request.BodyLength(); length < 0 {
+		proxyRequest.Headers["transfer-encoding"] = "chunked"
+	} else if length > 0 || hasLength || hasEncoding {
+		proxyRequest.Headers["content-length"] = strconv.FormatInt(length, 10)
 	}
-	localAddr := conn.LocalAddr().String()
-	proxyRequest.Headers["x-forwarded-for"] = GetLocalIpWithoutPort(localAddr)
-	proxyRequest.Headers["accept-encoding"] = "gzip, deflate, zstd"
+	SetForwardingHeaders(proxyRequest.Headers, request)
+	proxyRequest.Headers["accept-encoding"] = UpstreamAcceptEncoding(request.Headers["accept-encoding"])
 	proxyRequest.Headers["connection"] = "keep-alive"
+	if location.PreserveHost {
+		proxyRequest.Headers["host"] = request.Headers["host"]
+	}
+	location.ApplyRequestHeaderRules(proxyRequest.Headers, RequestVariables(request, location))
 
-	req, err := DialTarget(FormatTargetHost(targetHost))
-	if err != nil {
-		if strings.Contains(err.Error(), "i/o timeout") {
-			ErrorLog(err)
-			ServeError(conn, request, 504)
-			conn.Close()
-			return nil, err
-		} else {
-			ErrorLog(err)
-			ServeError(conn, request, 502)
-			conn.Close()
-			return nil, err
+	start := time.Now()
+	// Streamed bodies can only be sent to a single upstream
+	mirrored := location.Mirror.Sample() && (request.BodySource == nil || !request.BodySource.IsStreamed())
+	if mirrored {
+		MirrorRequest(proxyRequest, request, location)
+	}
+
+	_, pool, stickyCookie := location.SelectUpstreamGroup(request)
+	preferred, hasPreferred := location.Affinity.PreferredUpstream(request, pool)
+	retry := location.Retry
+	attempts := retry.MaxAttempts(request.Method)
+	tryTimeout := retry.TryTimeout()
+
+	var tried []string
+	var lastResponse *HttpRequest
+	var lastErr error
+	var lastKind string
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retry.BackoffDelay(attempt))
+		}
+		targetHost, ok := preferred, true
+		if attempt > 0 || !hasPreferred {
+			targetHost, ok = pool.Pick(tried)
+		}
+		if !ok {
+			if lastErr == nil {
+				lastErr = errors.New("no upstream configured")
+			}
+			break
+		}
+		tried = append(tried, targetHost)
+		// A response with a retryable status is only discarded once another upstream is tried, so that it can still
+		// be sent to the client otherwise
+		if lastResponse != nil {
+			if lastResponse.Stream != nil {
+				lastResponse.Stream.Close()
+			}
+			lastResponse = nil
+		}
+
+		response, kind, err := sendProxyRequest(proxyRequest, location, targetHost, tryTimeout)
+		if err != nil {
+			lastErr, lastKind, lastResponse = err, kind, nil
+			if kind == "" || !retry.ShouldRetry(kind) || !proxyRequest.CanResendBody() {
+				break
+			}
+			ErrorLog(fmt.Errorf("attempt %d to %s failed, retrying: %v", attempt+1, targetHost, err))
+			continue
 		}
+		location.RewriteUpstreamResponse(response.Headers, targetHost, request)
+		if stickyCookie != "" {
+			AppendHeader(response.Headers, "set-cookie", stickyCookie)
+		}
+		if cookie := location.Affinity.Track(request, response.Headers, targetHost); cookie != "" {
+			AppendHeader(response.Headers, "set-cookie", cookie)
+		}
+		if mirrored {
+			MirrorLog(request, "primary", targetHost, response.Status, time.Since(start), nil)
+		}
+		lastResponse = &response
+		if attempt < attempts-1 && retry.ShouldRetryStatus(response.Status) && proxyRequest.CanResendBody() {
+			ErrorLog(fmt.Errorf("attempt %d to %s returned status %d, retrying", attempt+1, targetHost, response.Status))
+			continue
+		}
+		return &response, nil
+	}
+	if lastResponse != nil {
+		return lastResponse, nil
+	}
+
+	if mirrored {
+		MirrorLog(request, "primary", strings.Join(tried, ", "), 0, time.Since(start), lastErr)
+	}
+	ErrorLog(lastErr)
+	var bodyErr *clientBodyError
+	switch {
+	case errors.As(lastErr, &bodyErr):
+		ServeError(conn, request, bodyErrorStatus(lastErr))
+	case lastKind == RetryOnTimeout:
+		ServeError(conn, request, 504)
+	case lastKind == RetryOnConnectFailure, lastKind == RetryOnReset:
+		ServeError(conn, request, 502)
+	default:
+		ServeError(conn, request, 500)
+	}
+	conn.Close()
+	return nil, lastErr
+}
+
+// parseTCPAddr parses an "ip:port" address, returning nil if it is not a valid TCP address.
+func parseTCPAddr(addr string) *net.TCPAddr {
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// clientTCPAddr returns the address of the client that sent the request. The port is only known if the client is the
+// peer of the connection, and not resolved from forwarding headers.
+func clientTCPAddr(request HttpRequest) net.Addr {
+	if addr := parseTCPAddr(request.RemoteAddr); addr != nil && addr.IP.String() == request.ClientIP {
+		return addr
+	}
+	ip := net.ParseIP(request.ClientIP)
+	if ip == nil {
+		return nil
 	}
+	return &net.TCPAddr{IP: ip}
+}
 
-	req.Write([]byte(request.Method + " " + request.Path + " " + "HTTP/1.1" + CRLF))
+// sendProxyRequest sends the request to a single upstream and reads its response, within tryTimeout if it is set.
+// On failure, it also returns the kind of failure (see ProxyFailureKind).
+func sendProxyRequest(proxyRequest HttpRequest, location HostLocation, upstream string, tryTimeout time.Duration) (HttpRequest, string, error) {
+	var deadline time.Time
+	if tryTimeout > 0 {
+		deadline = time.Now().Add(tryTimeout)
+	}
+	target, err := ParseUpstream(upstream)
+	if err != nil {
+		return HttpRequest{}, RetryOnConnectFailure, err
+	}
+	tlsConfig, err := location.UpstreamTLSConfig()
+	if err != nil {
+		return HttpRequest{}, RetryOnConnectFailure, err
+	}
+
+	headers := make(map[string]string, len(proxyRequest.Headers)+1)
 	for k, v := range proxyRequest.Headers {
-		req.Write([]byte(fmt.Sprintf("%s: %s\r\n", k, v)))
+		headers[k] = v
 	}
-	req.Write([]byte(CRLF))
-	if proxyRequest.Body != "" {
-		req.Write([]byte(proxyRequest.Body))
+	if _, ok := headers["host"]; !ok {
+		headers["host"] = target.HostHeader()
+		if location.UpstreamHost != "" {
+			headers["host"] = location.UpstreamHost
+		}
 	}
 
-	var response HttpRequest
-	response, err = ReadProxyResponse(req, request.Path)
+	var proxyHeader []byte
+	if version, _ := ParseProxyProtocolVersion(location.ProxyProtocol); version != 0 {
+		proxyHeader = EncodeProxyProtocolHeader(version, clientTCPAddr(proxyRequest), parseTCPAddr(proxyRequest.LocalAddr))
+	}
+
+	connectTimeout := location.Timeouts.ConnectTimeout()
+	if tryTimeout > 0 && tryTimeout < connectTimeout {
+		connectTimeout = tryTimeout
+	}
+	dialed, err := DialTarget(target, tlsConfig, proxyHeader, connectTimeout)
 	if err != nil {
-		if strings.Contains(err.Error(), "i/o timeout") {
-			ErrorLog(err)
-			ServeError(conn, request, 504)
-			conn.Close()
-			return nil, err
+		MarkUpstreamFailed(upstream)
+		return HttpRequest{}, ProxyFailureKind(err, false), err
+	}
+	req := &UpstreamConn{
+		Conn:             dialed,
+		SendTimeout:      location.Timeouts.SendTimeout(),
+		FirstByteTimeout: location.Timeouts.FirstByteTimeout(),
+		IdleTimeout:      location.Timeouts.IdleReadTimeout(),
+		Deadline:         deadline,
+	}
+
+	var head strings.Builder
+	head.WriteString(proxyRequest.Method + " " + JoinURLPath(target.BasePath, proxyRequest.Path) + " " + "HTTP/1.1" + CRLF)
+	for k, v := range headers {
+		head.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+	}
+	head.WriteString(CRLF)
+	head.WriteString(proxyRequest.Body)
+	if _, err := req.Write([]byte(head.String())); err != nil {
+		dialed.Close()
+		return HttpRequest{}, ProxyFailureKind(err, true), err
+	}
+	if proxyRequest.BodySource != nil {
+		if err := writeRequestBody(req, proxyRequest.BodySource); err != nil {
+			dialed.Close()
+			// Failures of the client are not failures of the upstream
+			var bodyErr *clientBodyError
+			if errors.As(err, &bodyErr) || errors.Is(err, errBodyConsumed) {
+				return HttpRequest{}, "", err
+			}
+			return HttpRequest{}, ProxyFailureKind(err, true), err
 		}
+	}
+
+	response, err := ReadProxyResponse(req, proxyRequest.Path, location)
+	if err != nil {
+		dialed.Close()
 		log.Println("Error reading proxy response:", err.Error())
-		ServeError(conn, request, 500)
-		return nil, err
+		return response, ProxyFailureKind(err, true), err
+	}
+	if response.Stream != nil {
+		// The connection is closed with the stream. Streams can stay open indefinitely, as long as data is received.
+		req.Deadline = time.Time{}
+		req.IdleTimeout = location.Timeouts.StreamIdleTimeout()
+		return response, "", nil
 	}
+	dialed.Close()
+	return response, "", nil
+}
 
-	return &response, nil
+// CanResendBody reports whether the body of the request can be sent again, e.g. to retry the request.
+func (request HttpRequest) CanResendBody() bool {
+	return request.BodySource == nil || request.BodySource.Replayable()
 }
 
-func ReadProxyResponse(conn net.Conn, path string) (HttpRequest, error) {
+// writeRequestBody sends a body that is not held in memory to an upstream, with chunked encoding if its length is
+// unknown.
+func writeRequestBody(conn net.Conn, body *RequestBody) error {
+	reader, err := body.Reader()
+	if err != nil {
+		return err
+	}
+	if body.Length() >= 0 {
+		_, err = io.Copy(conn, reader)
+		return err
+	}
+	chunked := httputil.NewChunkedWriter(conn)
+	if _, err := io.Copy(chunked, reader); err != nil {
+		return err
+	}
+	if err := chunked.Close(); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte(CRLF))
+	return err
+}
+
+// ReadProxyResponse reads the response of an upstream. The body is kept compressed, and its encoding is left in the
+// Content-Encoding header, unless the substitutions of the location apply to it. The body of streaming responses is
+// not read, but returned in the Stream of the response, which must be closed.
+func ReadProxyResponse(conn net.Conn, path string, location HostLocation) (HttpRequest, error) {
 	reader := bufio.NewReader(conn)
 
 	var response HttpRequest
@@ -160,7 +430,7 @@ func ReadProxyResponse(conn net.Conn, path string) (HttpRequest, error) {
 
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return response, fmt.Errorf("failed to read response line: %v", err)
+		return response, fmt.Errorf("failed to read response line: %w", err)
 	}
 
 	// Parse the response line. Example: "HTTP/1.1 200"
@@ -193,9 +463,7 @@ func ReadProxyResponse(conn net.Conn, path string) (HttpRequest, error) {
 		}
 		hparts := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 2)
 		if len(hparts) == 2 {
-			k := strings.TrimSpace(strings.ToLower(hparts[0]))
-			v := strings.TrimSpace(hparts[1])
-			response.Headers[k] = v
+			AppendHeader(response.Headers, hparts[0], strings.TrimSpace(hparts[1]))
 		} else {
 			log.Println("Malformed header:", line)
 			continue // Skip malformed headers
@@ -210,35 +478,58 @@ func ReadProxyResponse(conn net.Conn, path string) (HttpRequest, error) {
 		return response, nil
 	}
 
-	if ce, ok := response.Headers["content-encoding"]; ok && (strings.EqualFold(ce, "gzip") || strings.EqualFold(ce, "zstd") ||
-		strings.EqualFold(ce, "deflate")) {
-		// Handle chunked transfer encoding if present
-		if strings.EqualFold(response.Headers["transfer-encoding"], "chunked") {
-			reader = bufio.NewReader(httputil.NewChunkedReader(reader))
-		}
-		decompressed, err := DecompressBody(reader, strings.ToLower(ce))
-		if err != nil {
-			return response, fmt.Errorf("failed to decompress response body: %v", err)
-		}
-		bodyBytes, err := io.ReadAll(decompressed)
+	var body io.Reader
+	if te, ok := response.Headers["transfer-encoding"]; ok && strings.EqualFold(te, "chunked") {
+		body = httputil.NewChunkedReader(reader)
+	} else if cl, ok := response.Headers["content-length"]; ok {
+		length, err := strconv.ParseInt(cl, 10, 64)
 		if err != nil {
-			return response, fmt.Errorf("failed to read decompressed response body: %v", err)
+			return response, fmt.Errorf("invalid content length: %s", cl)
 		}
-		response.Body = string(bodyBytes)
+		body = &contentLengthReader{reader: reader, remaining: length}
+	}
+
+	encoding := strings.ToLower(response.Headers["content-encoding"])
+	if encoding == "identity" {
+		delete(response.Headers, "content-encoding")
+		encoding = ""
+	}
+	streaming := IsStreamingResponse(response.Headers, location)
+	if (encoding != "" || streaming) && body == nil {
+		// Without a length, the compressed stream or the connection ends the body
+		body = reader
+	}
+	if body == nil {
 		return response, nil
 	}
 
-	if te, ok := response.Headers["transfer-encoding"]; ok && strings.EqualFold(te, "chunked") {
-		response.Body, err = ReadChunkedBody(reader)
-		if err != nil {
-			return response, err
-		}
-	} else if cl, ok := response.Headers["content-length"]; ok {
-		response.Body, err = ReadContentLengthBody(reader, cl)
-		if err != nil {
-			return response, err
+	var closers []io.Closer
+	substitutions := location.Substitutions
+	if substitutions.AppliesTo(response.Headers["content-type"]) && (encoding == "" || slices.Contains(SupportedEncodings, encoding)) {
+		// The body is only decompressed when it must be modified, otherwise it is sent to the client as is
+		if encoding != "" {
+			decompressed, err := NewDecompressReader(body, encoding)
+			if err != nil {
+				return response, fmt.Errorf("failed to decompress response body: %w", err)
+			}
+			closers = append(closers, decompressed)
+			body = decompressed
+			delete(response.Headers, "content-encoding")
 		}
+		body = substitutions.NewReader(body)
+	}
+	if streaming {
+		response.Stream = &streamBody{Reader: body, conn: conn, closers: closers}
+		return response, nil
 	}
 
+	bodyBytes, err := io.ReadAll(body)
+	for _, closer := range closers {
+		_ = closer.Close()
+	}
+	if err != nil {
+		return response, fmt.Errorf("failed to read response body: %w", err)
+	}
+	response.Body = string(bodyBytes)
 	return response, nil
 }
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		address string
+		want    UpstreamTarget
+		wantErr bool
+	}{
+		{address: "http://backend", want: UpstreamTarget{Scheme: "http", Address: "backend:80", Hostname: "backend"}},
+		{address: "https://backend", want: UpstreamTarget{Scheme: "https", Address: "backend:443", Hostname: "backend"}},
+		{address: "HTTP://10.0.0.5:8080/", want: UpstreamTarget{Scheme: "http", Address: "10.0.0.5:8080", Hostname: "10.0.0.5"}},
+		{address: "https://backend:8443/app/", want: UpstreamTarget{Scheme: "https", Address: "backend:8443", Hostname: "backend", BasePath: "/app"}},
+		{address: "http://[2001:db8::1]:8080", want: UpstreamTarget{Scheme: "http", Address: "[2001:db8::1]:8080", Hostname: "2001:db8::1"}},
+		{address: "https://[2001:db8::1]/base", want: UpstreamTarget{Scheme: "https", Address: "[2001:db8::1]:443", Hostname: "2001:db8::1", BasePath: "/base"}},
+		{address: "http://[::1]:9000/a%20b", want: UpstreamTarget{Scheme: "http", Address: "[::1]:9000", Hostname: "::1", BasePath: "/a%20b"}},
+		{address: "unix:/run/app.sock", want: UpstreamTarget{Scheme: "unix", Address: "/run/app.sock", Hostname: "localhost"}},
+		{address: "unix:/run/app.sock:/base/", want: UpstreamTarget{Scheme: "unix", Address: "/run/app.sock", Hostname: "localhost", BasePath: "/base"}},
+		{address: "backend:8080", wantErr: true},
+		{address: "10.0.0.5:443", wantErr: true},
+		{address: "[2001:db8::1]:8080", wantErr: true},
+		{address: "http://2001:db8::1:8080", wantErr: true},
+		{address: "http://[2001:db8::1", wantErr: true},
+		{address: "http://backend:0", wantErr: true},
+		{address: "http://backend:70000", wantErr: true},
+		{address: "http://backend:port", wantErr: true},
+		{address: "http://:8080", wantErr: true},
+		{address: "ftp://backend", wantErr: true},
+		{address: "http://backend/?a=1", wantErr: true},
+		{address: "unix:", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseUpstream(test.address)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseUpstream(%q) = %+v, want an error", test.address, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseUpstream(%q) returned error: %v", test.address, err)
+		} else if got != test.want {
+			t.Errorf("ParseUpstream(%q) = %+v, want %+v", test.address, got, test.want)
+		}
+	}
+}
+
+func TestUpstreamTargetHostHeader(t *testing.T) {
+	for address, want := range map[string]string{
+		"http://backend:8080":       "backend",
+		"http://10.0.0.5":           "10.0.0.5",
+		"http://[2001:db8::1]:8080": "[2001:db8::1]",
+	} {
+		target, err := ParseUpstream(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := target.HostHeader(); got != want {
+			t.Errorf("HostHeader() of %s = %q, want %q", address, got, want)
+		}
+	}
+}
@@ -20,6 +20,7 @@ Each frame has a 9-byte header:
 const (
 	DataFrameType         byte = 0x0
 	HeadersFrameType      byte = 0x1
+	RSTStreamFrameType    byte = 0x3
 	SettingsFrameType     byte = 0x4
 	WindowUpdateFrameType byte = 0x7
 	PingFrameType         byte = 0x8
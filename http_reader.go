@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"iridium/http2"
 	"log"
 	"net"
+	"net/http/httputil"
 	"slices"
 	"strconv"
 	"strings"
@@ -29,11 +31,44 @@ type HttpRequest struct {
 	Body     string
 	Status   int
 	StreamID *uint32
+	// Address of the peer that sent the request, including the port.
+	RemoteAddr string
+	// Address the request was received on, including the port.
+	LocalAddr string
+	// IP address of the client, resolved from forwarding headers sent by trusted proxies.
+	ClientIP string
+	// Either "http" or "https", depending on the connection the request was received on.
+	Scheme string
+	// Random identifier of the request, available as the $request_id variable.
+	ID string
+	// Negotiated TLS version (e.g. "TLS 1.3"), or empty for plain HTTP.
+	TLSVersion string
+	// PROXY protocol header received before the request, if any.
+	ProxyProtocol *ProxyProtocolHeader
+	// Body of a streamed upstream response, read as it is received. Body is empty when it is set.
+	Stream io.ReadCloser
+	// Body of a client request that is not held in Body, because it is large or streamed. Body is empty when it is set.
+	BodySource *RequestBody
+	// Named captures of the regex of the location matching the request, available as variables.
+	LocationCaptures map[string]string
+
+	// Unread body of a request whose head was read by ReadRequestHead, and its length (-1 if chunked).
+	body       io.Reader
+	bodyLength int64
+}
+
+// BodyLength returns the size of the request body, or -1 if it is streamed with an unknown size.
+func (request HttpRequest) BodyLength() int64 {
+	if request.BodySource != nil {
+		return request.BodySource.Length()
+	}
+	return int64(len(request.Body))
 }
 
-// ReadRequest reads and parses an HTTP request from the given connection.
-// It supports both HTTP/1.x and HTTP/2 based on the ALPN protocol.
-func ReadRequest(conn net.Conn, alpnProto string) (HttpRequest, error) {
+// ReadRequestHead reads and parses the request line and headers of an HTTP request from the given connection.
+// It supports both HTTP/1.x and HTTP/2 based on the ALPN protocol. The body of HTTP/1.x requests is left unread, so
+// that it can be rejected before it is received, and must be read with ReadRequestBody.
+func ReadRequestHead(conn net.Conn, alpnProto string) (HttpRequest, error) {
 	reader := bufio.NewReader(conn)
 	var request HttpRequest
 
@@ -55,7 +90,7 @@ func ReadRequest(conn net.Conn, alpnProto string) (HttpRequest, error) {
 	// Fallback to HTTP/1.x or h2c (HTTP/2 cleartext) parsing
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return request, fmt.Errorf("failed to read request line: %v", err)
+		return request, fmt.Errorf("failed to read request line: %w", err)
 	}
 
 	var method, path, version string
@@ -109,60 +144,40 @@ func ReadRequest(conn net.Conn, alpnProto string) (HttpRequest, error) {
 		}
 	}
 
-	// Read body if Content-Length is specified
 	if te, ok := request.Headers["transfer-encoding"]; ok && strings.EqualFold(te, "chunked") {
-		request.Body, err = ReadChunkedBody(reader)
-		if err != nil {
-			return request, err
-		}
+		request.body = httputil.NewChunkedReader(reader)
+		request.bodyLength = -1
 	} else if cl, ok := request.Headers["content-length"]; ok {
-		request.Body, err = ReadContentLengthBody(reader, cl)
-		if err != nil {
-			return request, err
+		length, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || length < 0 {
+			return request, fmt.Errorf("invalid content length: %s", cl)
+		}
+		if length > 0 {
+			request.body = &contentLengthReader{reader: reader, remaining: length}
+			request.bodyLength = length
 		}
 	}
 
 	return request, nil
 }
 
-func ReadContentLengthBody(reader *bufio.Reader, contentLength string) (string, error) {
-	length, err := strconv.Atoi(contentLength)
-	if err != nil {
-		return "", err
-	}
-	body := make([]byte, length)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
-		return "", err
-	}
-	return string(body), nil
+// contentLengthReader reads exactly the given number of bytes, and fails if the underlying reader ends before.
+type contentLengthReader struct {
+	reader    io.Reader
+	remaining int64
 }
 
-func ReadChunkedBody(reader *bufio.Reader) (string, error) {
-	var body strings.Builder
-	for {
-		sizeLine, err := reader.ReadString('\n')
-		if err != nil {
-			return "", err
-		}
-		sizeLine = strings.TrimSpace(sizeLine)
-		size, err := strconv.ParseInt(sizeLine, 16, 64)
-		if err != nil {
-			return "", err
-		}
-		if size == 0 {
-			// Read and discard trailing CRLF after last chunk
-			_, _ = reader.ReadString('\n')
-			break
-		}
-		chunk := make([]byte, size)
-		_, err = io.ReadFull(reader, chunk)
-		if err != nil {
-			return "", err
-		}
-		body.Write(chunk)
-		// Read and discard trailing CRLF after each chunk
-		_, _ = reader.ReadString('\n')
+func (r *contentLengthReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
 	}
-	return body.String(), nil
+	return n, err
 }
@@ -7,6 +7,7 @@ import (
 	"iridium/http2"
 	"net"
 	"net/http"
+	"os"
 	"slices"
 	"strings"
 	"time"
@@ -14,6 +15,58 @@ import (
 	"golang.org/x/net/http2/hpack"
 )
 
+// Responses to requests whose Host header doesn't match any host ("server.unmatched_host.action").
+const (
+	UnmatchedHostWelcome = "welcome"
+	UnmatchedHostStatus  = "status"
+	UnmatchedHostClose   = "close"
+)
+
+// unmatchedHost is the response to unmatched hosts, loaded at startup by LoadUnmatchedHost.
+var unmatchedHost = struct {
+	action string
+	status int
+	page   *string
+}{action: UnmatchedHostWelcome, status: 421}
+
+// LoadUnmatchedHost loads "server.unmatched_host" once, including its page, and returns an error if it is invalid.
+func LoadUnmatchedHost() error {
+	action := strings.ToLower(GetConfigValue("server.unmatched_host.action", UnmatchedHostWelcome).(string))
+	if action != UnmatchedHostWelcome && action != UnmatchedHostStatus && action != UnmatchedHostClose {
+		return fmt.Errorf("unsupported server.unmatched_host.action: %s", action)
+	}
+	status, _ := GetConfigValue("server.unmatched_host.status", 421).(int)
+	if status < 100 || status > 599 {
+		return fmt.Errorf("invalid server.unmatched_host.status: %d", status)
+	}
+	unmatchedHost.action, unmatchedHost.status = action, status
+	if path := GetConfigValue("server.unmatched_host.page", "").(string); path != "" {
+		page, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read server.unmatched_host.page: %v", err)
+		}
+		unmatchedHost.page = StrPtr(string(page))
+	}
+	return nil
+}
+
+// ServeUnmatchedHost answers a request whose Host header doesn't match any host, as configured in
+// "server.unmatched_host". The connection is closed without a response for the "close" action.
+func ServeUnmatchedHost(conn net.Conn, request HttpRequest) {
+	switch unmatchedHost.action {
+	case UnmatchedHostClose:
+		return
+	case UnmatchedHostStatus:
+		if unmatchedHost.page != nil {
+			ServeResponse(conn, request, ResponseServed{Status: unmatchedHost.status, Body: *unmatchedHost.page})
+			return
+		}
+		ServeError(conn, request, unmatchedHost.status)
+	default:
+		ServeResponse(conn, request, ResponseServed{Status: 200, Body: FallbackHtml()})
+	}
+}
+
 func FallbackHtml() string {
 	html := `<!DOCTYPE html>
 <html>
@@ -58,6 +111,10 @@ type ResponseServed struct {
 	Body        string
 	ContentType *string
 	Headers     map[string]string
+	// Content encoding the body is already compressed with, e.g. by an upstream. Empty if the body is not compressed.
+	ContentEncoding string
+	// If set, the body is read from Stream and sent to the client as it is received, instead of Body.
+	Stream io.ReadCloser
 }
 
 func ServeResponse(conn net.Conn, request HttpRequest, resp ResponseServed) {
@@ -85,6 +142,11 @@ func ServeResponse(conn net.Conn, request HttpRequest, resp ResponseServed) {
 		}
 	}
 
+	if resp.Stream != nil {
+		serveStream(conn, request, resp)
+		return
+	}
+
 	var encoding string
 	clientEncodings := request.Headers["accept-encoding"]
 	if clientEncodings != "" {
@@ -106,8 +168,25 @@ func ServeResponse(conn net.Conn, request HttpRequest, resp ResponseServed) {
 		// Fallback to no encoding if client does not support any
 		encoding = "none"
 	}
-	isValidEncoding := encoding == "zstd" || encoding == "gzip" || encoding == "deflate"
-	contentBody, contentLength := GetContentBody([]byte(resp.Body), encoding)
+	var contentBody []byte
+	var contentLength int
+	if resp.ContentEncoding != "" && AcceptsEncoding(request.Headers["accept-encoding"], resp.ContentEncoding) {
+		// The body is sent as is, without being compressed again
+		encoding = resp.ContentEncoding
+		contentBody, contentLength = []byte(resp.Body), len(resp.Body)
+	} else if resp.ContentEncoding != "" && resp.Body != "" {
+		decompressed, err := DecompressBody([]byte(resp.Body), resp.ContentEncoding)
+		if err != nil {
+			// The client can't decode the body as it is
+			ErrorLog(fmt.Errorf("failed to decompress response: %v", err))
+			ServeError(conn, request, 502)
+			return
+		}
+		contentBody, contentLength = GetContentBody(decompressed, encoding)
+	} else {
+		contentBody, contentLength = GetContentBody([]byte(resp.Body), encoding)
+	}
+	isValidEncoding := encoding != "none"
 
 	if resp.ContentType == nil {
 		defaultType := "text/html; charset=utf-8"
@@ -132,7 +211,10 @@ func ServeResponse(conn net.Conn, request HttpRequest, resp ResponseServed) {
 				if slices.Contains(ServerIgnoredHeaders, k) {
 					continue
 				}
-				response += fmt.Sprintf("%s: %s\r\n", k, v)
+				// Multiple values of a header (e.g. Set-Cookie) are sent as separate lines
+				for _, line := range strings.Split(v, "\n") {
+					response += fmt.Sprintf("%s: %s\r\n", k, line)
+				}
 			}
 		}
 		response += "\r\n"
@@ -162,7 +244,9 @@ func ServeResponse(conn net.Conn, request HttpRequest, resp ResponseServed) {
 				if slices.Contains(ServerIgnoredHeaders, k) {
 					continue
 				}
-				responseHeaders = append(responseHeaders, hpack.HeaderField{Name: k, Value: v})
+				for _, line := range strings.Split(v, "\n") {
+					responseHeaders = append(responseHeaders, hpack.HeaderField{Name: k, Value: line})
+				}
 			}
 		}
 		var buf bytes.Buffer
@@ -220,8 +304,14 @@ func ErrorHTML(status int) string {
 		statusText = "Forbidden"
 	case 404:
 		statusText = "Not Found"
+	case 408:
+		statusText = "Request Timeout"
+	case 413:
+		statusText = "Content Too Large"
 	case 416:
 		statusText = "Range Not Satisfiable"
+	case 421:
+		statusText = "Misdirected Request"
 	case 500:
 		statusText = "Internal Server Error"
 	case 502:
@@ -15,6 +15,7 @@ func StartHTTPSRedirector() {
 		fmt.Printf("Failed to start HTTP redirector: %v\n", err)
 		return
 	}
+	listener = WrapProxyProtocolListener(listener)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
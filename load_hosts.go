@@ -1,18 +1,42 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Host struct {
-	// The IP address or hostname that will be matched against the "Host" header of incoming requests.
-	Domain    string          `yaml:"domain"`
+	// The IP address or hostname that will be matched against the "Host" header of incoming requests. Leading
+	// wildcards match every subdomain, e.g. "*.example.com", and names starting with "~" are regexes, e.g.
+	// "~^api[0-9]+\.example\.com$". Exact names are matched first, then wildcards, then regexes.
+	Domain string `yaml:"domain"`
+	// Additional names of this host, matched like Domain.
+	Domains []string `yaml:"domains,omitempty"`
+	// Use this host for requests whose name doesn't match any host.
+	Default   bool            `yaml:"default,omitempty"`
 	Locations []HostLocation  `yaml:"locations"`
 	EdgeCache EdgeCacheConfig `yaml:"edge_cache,omitempty"`
+	// Changes made to the headers of requests sent upstream, for every location of this host.
+	RequestHeaders *HeaderRules `yaml:"request_headers,omitempty"`
+	// Changes made to the headers of responses sent to clients, for every location of this host.
+	ResponseHeaders *HeaderRules `yaml:"response_headers,omitempty"`
+	// Maximum size of request bodies for every location of this host, e.g. "10M". Larger requests receive a 413
+	// response. Default is no limit.
+	MaxBodySize string `yaml:"max_body_size,omitempty"`
+	// Forward TLS connections for this host to upstreams without terminating them. Requires TLS to be configured.
+	// Locations are not used for these connections.
+	TLSPassthrough *TLSPassthroughConfig `yaml:"tls_passthrough,omitempty"`
+
+	passthrough *Stream
+	serverNames serverNames
+	// Closed to stop the background tasks of the host, see Start
+	stop chan struct{}
 }
 
 type EdgeCacheConfig struct {
@@ -25,16 +49,273 @@ type EdgeCacheConfig struct {
 }
 
 type HostLocation struct {
-	// Match pattern for the URL path of this location.
+	// Match pattern for the URL path of this location, without the query string:
+	//   - "= /path" or "/path": exact match
+	//   - "/path/*": prefix match, "*" matches every path
+	//   - "~ regex": regex match, e.g. "~ ^/users/(?P<id>[0-9]+)$", or "~* regex" to ignore case. Named captures, made of
+	//     lowercase letters and underscores, are available as variables in rewrites, contents and headers, e.g. "$id".
+	// Exact matches are used first, then the first matching regex, then the longest matching prefix.
 	Match string `yaml:"match"`
-	// If specified, will proxy requests to this address.
+	// If specified, will proxy requests to this address, e.g. "http://127.0.0.1:3000" or "unix:/run/app.sock".
 	Proxy *string `yaml:"proxy,omitempty"`
+	// Additional addresses to load balance proxied requests across, together with Proxy if it is set.
+	Upstreams []string `yaml:"upstreams,omitempty"`
+	// Adds the upstreams of this service found by the discovery providers, e.g. the "iridium.service" label of Docker
+	// containers.
+	Discover string `yaml:"discover,omitempty"`
+	// Adds the upstreams found by resolving a DNS name, kept up to date as the DNS records change.
+	DNS *DNSDiscoveryConfig `yaml:"dns,omitempty"`
+	// TLS settings for "https://" upstreams.
+	TLS *UpstreamTLSConfig `yaml:"tls,omitempty"`
+	// PROXY protocol header to send to upstreams, carrying the client address: "v1" or "v2". Default is none.
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty"`
+	// Substitutions applied to the body of proxied responses.
+	Substitutions *SubstitutionConfig `yaml:"substitutions,omitempty"`
+	// Rewriting of the upstream address in the redirects and cookies of proxied responses.
+	UpstreamRewrite *UpstreamRewriteConfig `yaml:"upstream_rewrite,omitempty"`
+	// Send every proxied response to the client as it is received, without compression or caching. Server-Sent Events
+	// and chunked responses are always streamed.
+	Streaming bool `yaml:"streaming,omitempty"`
+	// Routes part of the traffic to other groups of upstreams, e.g. a canary version.
+	Split *SplitConfig `yaml:"split,omitempty"`
+	// Keeps the requests of a client on the same upstream.
+	Affinity *AffinityConfig `yaml:"affinity,omitempty"`
+	// Shadow upstreams receiving a copy of the proxied requests.
+	Mirror *MirrorConfig `yaml:"mirror,omitempty"`
+	// Maximum size of request bodies, e.g. "10M". Larger requests receive a 413 response. Default is the limit of the
+	// host.
+	MaxBodySize string `yaml:"max_body_size,omitempty"`
+	// Either "buffer" (receive the whole request body before contacting upstreams) or "stream" (send the request body
+	// to upstreams as it is received, without retries or mirroring). Default is buffer.
+	RequestBuffering string `yaml:"request_buffering,omitempty"`
+	// Buffered request bodies larger than this are written to a temporary file instead of memory, e.g. "8M".
+	// Default is 1M.
+	BodyBufferSize string `yaml:"body_buffer_size,omitempty"`
+	// Timeouts of requests sent to upstreams.
+	Timeouts *ProxyTimeouts `yaml:"timeouts,omitempty"`
+	// Retry policy for proxied requests that fail. By default, failed requests are not retried.
+	Retry *RetryConfig `yaml:"retry,omitempty"`
+	// If specified, will pass requests to this FastCGI server, e.g. php-fpm.
+	FastCGI *FastCGIConfig `yaml:"fastcgi,omitempty"`
 	// If specified, will serve static files from this directory.
 	Root *string `yaml:"root,omitempty"`
 	// If specified, will respond with this content.
 	Content *string `yaml:"content,omitempty"`
+	// Rewrite rules for the request path, applied before the request is cached, logged and proxied.
+	Rewrite *RewriteConfig `yaml:"rewrite,omitempty"`
 	// Additional headers to include in the response.
 	Headers *map[string]string `yaml:"headers,omitempty"`
+	// Changes made to the headers of requests sent upstream. Applied after the rules of the host.
+	RequestHeaders *HeaderRules `yaml:"request_headers,omitempty"`
+	// Changes made to the headers of responses sent to clients. Applied after the rules of the host.
+	ResponseHeaders *HeaderRules `yaml:"response_headers,omitempty"`
+	// Send the Host header of the client to upstreams, instead of the upstream hostname.
+	PreserveHost bool `yaml:"preserve_host,omitempty"`
+	// Host header sent to upstreams, instead of the upstream hostname. Useful for Unix domain socket upstreams,
+	// which are sent "localhost" by default.
+	UpstreamHost string `yaml:"upstream_host,omitempty"`
+
+	matcher             locationMatcher
+	maxBodySize         int64
+	bodyBufferSize      int64
+	pool                *UpstreamPool
+	upstreamTLS         *tls.Config
+	hostRequestHeaders  *HeaderRules
+	hostResponseHeaders *HeaderRules
+}
+
+// ApplyRequestHeaderRules applies the request header rules of the host, then the ones of this location.
+func (location HostLocation) ApplyRequestHeaderRules(headers map[string]string, variables map[string]string) {
+	location.hostRequestHeaders.Apply(headers, variables)
+	location.RequestHeaders.Apply(headers, variables)
+}
+
+// ApplyResponseHeaderRules adds the static headers of this location if they are not already set, then applies the
+// response header rules of the host and of this location.
+func (location HostLocation) ApplyResponseHeaderRules(headers map[string]string, variables map[string]string) {
+	for k, v := range PopulateHeaders(location.Headers) {
+		if _, ok := headers[k]; !ok {
+			headers[k] = v
+		}
+	}
+	location.hostResponseHeaders.Apply(headers, variables)
+	location.ResponseHeaders.Apply(headers, variables)
+}
+
+// IsProxy reports whether requests matching this location are proxied to upstream servers.
+func (location HostLocation) IsProxy() bool {
+	return location.Proxy != nil || len(location.Upstreams) > 0 || location.DNS != nil || location.Discover != "" || (location.Split != nil && len(location.Split.Groups) > 0)
+}
+
+// Pool returns the upstream pool of this location, creating one if the location was not prepared by LoadHosts.
+func (location HostLocation) Pool() *UpstreamPool {
+	if location.pool != nil {
+		return location.pool
+	}
+	return NewUpstreamPool(location.UpstreamAddresses())
+}
+
+// UpstreamTLSConfig returns the TLS config used to connect to the "https://" upstreams of this location.
+func (location HostLocation) UpstreamTLSConfig() (*tls.Config, error) {
+	if location.upstreamTLS != nil {
+		return location.upstreamTLS, nil
+	}
+	return location.TLS.Build()
+}
+
+// UpstreamAddresses returns every upstream address of this location, starting with Proxy.
+func (location HostLocation) UpstreamAddresses() []string {
+	var addresses []string
+	if location.Proxy != nil {
+		addresses = append(addresses, *location.Proxy)
+	}
+	return append(addresses, location.Upstreams...)
+}
+
+// prepareRequestBody validates the request body settings of this location.
+func (location *HostLocation) prepareRequestBody(hostMaxBodySize int64) error {
+	location.maxBodySize = hostMaxBodySize
+	if location.MaxBodySize != "" {
+		size, err := ParseByteSize(location.MaxBodySize)
+		if err != nil {
+			return fmt.Errorf("max_body_size: %v", err)
+		}
+		location.maxBodySize = size
+	}
+	if location.BodyBufferSize != "" {
+		size, err := ParseByteSize(location.BodyBufferSize)
+		if err != nil {
+			return fmt.Errorf("body_buffer_size: %v", err)
+		}
+		location.bodyBufferSize = size
+	}
+	location.RequestBuffering = strings.ToLower(location.RequestBuffering)
+	switch location.RequestBuffering {
+	case "", RequestBufferingBuffer, RequestBufferingStream:
+		return nil
+	}
+	return fmt.Errorf("unsupported request_buffering: %s", location.RequestBuffering)
+}
+
+// PrepareHost validates a host after it has been parsed and initializes its runtime state.
+func PrepareHost(host *Host) error {
+	if err := host.compileServerNames(); err != nil {
+		return err
+	}
+	if host.TLSPassthrough != nil {
+		stream, err := NewPassthroughStream("tls_passthrough "+host.Domain, host.TLSPassthrough.Upstreams, host.TLSPassthrough.ProxyProtocol)
+		if err != nil {
+			return err
+		}
+		stream.HealthCheck = host.TLSPassthrough.HealthCheck
+		host.passthrough = stream
+	}
+	var hostMaxBodySize int64
+	if host.MaxBodySize != "" {
+		size, err := ParseByteSize(host.MaxBodySize)
+		if err != nil {
+			return fmt.Errorf("max_body_size: %v", err)
+		}
+		hostMaxBodySize = size
+	}
+	for i := range host.Locations {
+		location := &host.Locations[i]
+		location.hostRequestHeaders = host.RequestHeaders
+		location.hostResponseHeaders = host.ResponseHeaders
+		if err := location.compileMatch(); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if err := location.prepareRequestBody(hostMaxBodySize); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if err := location.Rewrite.Compile(); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if err := location.FastCGI.Compile(); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if !location.IsProxy() {
+			continue
+		}
+		for _, address := range location.UpstreamAddresses() {
+			if _, err := ParseUpstream(address); err != nil {
+				return fmt.Errorf("location %s: %v", location.Match, err)
+			}
+		}
+		if _, err := ParseProxyProtocolVersion(location.ProxyProtocol); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if err := location.Substitutions.Compile(); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if err := location.Affinity.Validate(); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if location.Affinity != nil {
+			location.Affinity.scope = host.Domain + " " + location.Match
+		}
+		hasDefaultUpstreams := len(location.UpstreamAddresses()) > 0 || location.DNS != nil || location.Discover != ""
+		if err := location.Split.Prepare(hasDefaultUpstreams); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		if location.Mirror != nil {
+			for _, address := range location.Mirror.Upstreams {
+				if _, err := ParseUpstream(address); err != nil {
+					return fmt.Errorf("location %s: mirror: %v", location.Match, err)
+				}
+			}
+		}
+		if err := location.DNS.Validate(); err != nil {
+			return fmt.Errorf("location %s: %v", location.Match, err)
+		}
+		location.pool = NewUpstreamPool(location.UpstreamAddresses())
+		if location.DNS != nil {
+			if len(location.UpstreamAddresses()) == 0 {
+				// Upstreams are addressed by IP, so the name of the service is used for the Host header and the server
+				// name
+				if location.UpstreamHost == "" {
+					location.UpstreamHost = location.DNS.ServiceName()
+				}
+				if location.DNS.Scheme == "https" {
+					if location.TLS == nil {
+						location.TLS = &UpstreamTLSConfig{}
+					}
+					if location.TLS.ServerName == "" {
+						location.TLS.ServerName = location.DNS.ServiceName()
+					}
+				}
+			}
+		}
+		tlsConfig, err := location.TLS.Build()
+		if err != nil {
+			return fmt.Errorf("location %s: invalid upstream TLS config: %v", location.Match, err)
+		}
+		location.upstreamTLS = tlsConfig
+	}
+	return nil
+}
+
+// Start starts the background tasks of a prepared host, such as DNS discovery and health checks, until Stop is called. Hosts are only
+// started once they are fully validated, so that invalid hosts leave nothing running.
+func (host *Host) Start() {
+	host.stop = make(chan struct{})
+	if host.passthrough != nil {
+		StartHealthChecks(host.passthrough.name, host.passthrough.pool, host.passthrough.HealthCheck, host.stop)
+	}
+	for i := range host.Locations {
+		location := &host.Locations[i]
+		if location.DNS != nil {
+			StartDNSDiscovery(location.DNS, location.pool, host.stop)
+		}
+	}
+}
+
+// Stop stops the background tasks of the host.
+func (host *Host) Stop() {
+	if host.stop != nil {
+		close(host.stop)
+		host.stop = nil
+	}
 }
 
 func LoadHosts() ([]Host, error) {
@@ -70,6 +351,10 @@ edge_cache:
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse default host file: %v", err)
 		}
+		if err := PrepareHost(&host); err != nil {
+			return nil, fmt.Errorf("failed to prepare default host file: %v", err)
+		}
+		host.Start()
 		return []Host{host}, nil
 	} else {
 		// Load existing host configurations
@@ -100,25 +385,49 @@ edge_cache:
 				println("Failed to parse host file", path, ":", err.Error())
 				continue
 			}
+			if err := PrepareHost(&host); err != nil {
+				println("Invalid host file", path, ":", err.Error())
+				continue
+			}
+			host.Start()
 			hosts = append(hosts, host)
 		}
 		return hosts, nil
 	}
 }
 
-func FindHost(hosts []Host, domain string) *Host {
-	for _, host := range hosts {
-		if strings.EqualFold(host.Domain, domain) {
-			return &host
-		}
-	}
-	return nil
+// HostStore holds the hosts loaded from the hosts directory, and the hosts generated by the discovery providers.
+type HostStore struct {
+	static    []Host
+	generated []Host
+	mu        sync.RWMutex
 }
 
-func IsLocationMatching(match string, path string) bool {
-	if strings.HasSuffix(match, "*") {
-		prefix := strings.TrimSuffix(match, "*")
-		return strings.HasPrefix(path, prefix)
+func NewHostStore(hosts []Host) *HostStore {
+	return &HostStore{static: hosts}
+}
+
+// Hosts returns every host. Hosts loaded from the hosts directory come first, so they take precedence.
+func (store *HostStore) Hosts() []Host {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return append(slices.Clone(store.static), store.generated...)
+}
+
+// Static returns the hosts loaded from the hosts directory.
+func (store *HostStore) Static() []Host {
+	return store.static
+}
+
+// SetGenerated replaces the hosts generated by the discovery providers. The previous hosts are stopped.
+func (store *HostStore) SetGenerated(hosts []Host) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i := range store.generated {
+		store.generated[i].Stop()
+	}
+	for i := range hosts {
+		hosts[i].Start()
 	}
-	return match == path
+	store.generated = hosts
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Kinds of location match patterns, see HostLocation.Match.
+const (
+	locationMatchExact = iota
+	locationMatchPrefix
+	locationMatchRegex
+)
+
+// locationMatcher is the compiled match pattern of a location.
+type locationMatcher struct {
+	kind int
+	// Path of exact matches, or prefix of prefix matches
+	path  string
+	regex *regexp.Regexp
+}
+
+// compileMatch parses the match pattern of the location:
+//   - "= /path" or "/path": the path only
+//   - "/path/*": every path starting with "/path/", and "*" every path
+//   - "~ regex": paths matching the regex, "~* regex" ignoring case
+func (location *HostLocation) compileMatch() error {
+	match := strings.TrimSpace(location.Match)
+	if pattern, ok := strings.CutPrefix(match, "~*"); ok {
+		return location.compileMatchRegex("(?i)" + strings.TrimSpace(pattern))
+	} else if pattern, ok := strings.CutPrefix(match, "~"); ok {
+		return location.compileMatchRegex(strings.TrimSpace(pattern))
+	} else if path, ok := strings.CutPrefix(match, "="); ok {
+		location.matcher = locationMatcher{kind: locationMatchExact, path: strings.TrimSpace(path)}
+	} else if prefix, ok := strings.CutSuffix(match, "*"); ok {
+		location.matcher = locationMatcher{kind: locationMatchPrefix, path: prefix}
+	} else if match == "" {
+		return fmt.Errorf("match is required")
+	} else {
+		location.matcher = locationMatcher{kind: locationMatchExact, path: match}
+	}
+	if strings.Contains(location.matcher.path, "*") {
+		return fmt.Errorf("only trailing wildcards are supported: %s", location.Match)
+	}
+	return nil
+}
+
+func (location *HostLocation) compileMatchRegex(pattern string) error {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid match regex %s: %v", pattern, err)
+	}
+	// Captures are request variables, so they need variable names and can't replace the built-in ones
+	builtin := RequestVariables(HttpRequest{}, HostLocation{})
+	for _, name := range regex.SubexpNames() {
+		if name != "" && !isVariableName(name) {
+			return fmt.Errorf("match regex capture %q must be made of lowercase letters and underscores", name)
+		}
+		if _, ok := builtin[name]; ok {
+			return fmt.Errorf("match regex capture %q is the name of a built-in variable", name)
+		}
+	}
+	location.matcher = locationMatcher{kind: locationMatchRegex, regex: regex}
+	return nil
+}
+
+// captures returns the named captures of a regex match of the path.
+func (matcher locationMatcher) captures(path string) (map[string]string, bool) {
+	match := matcher.regex.FindStringSubmatch(path)
+	if match == nil {
+		return nil, false
+	}
+	captures := make(map[string]string)
+	for i, name := range matcher.regex.SubexpNames() {
+		if name != "" {
+			captures[name] = match[i]
+		}
+	}
+	return captures, true
+}
+
+// FindLocation returns the location of the host handling the path, or nil if there is none, with the named captures of
+// its regex. The query string is not matched. Exact matches take precedence, then regexes, in order, and the longest
+// prefix is used last.
+func (host *Host) FindLocation(path string) (*HostLocation, map[string]string) {
+	path, _, _ = strings.Cut(path, "?")
+	for i := range host.Locations {
+		if matcher := host.Locations[i].matcher; matcher.kind == locationMatchExact && matcher.path == path {
+			return &host.Locations[i], nil
+		}
+	}
+	for i := range host.Locations {
+		if matcher := host.Locations[i].matcher; matcher.kind == locationMatchRegex {
+			if captures, ok := matcher.captures(path); ok {
+				return &host.Locations[i], captures
+			}
+		}
+	}
+	var longest *HostLocation
+	for i := range host.Locations {
+		matcher := host.Locations[i].matcher
+		if matcher.kind == locationMatchPrefix && strings.HasPrefix(path, matcher.path) &&
+			(longest == nil || len(matcher.path) > len(longest.matcher.path)) {
+			longest = &host.Locations[i]
+		}
+	}
+	return longest, nil
+}
@@ -9,6 +9,7 @@ import (
 var AccessLogFile = GetDataDirectory() + string(os.PathSeparator) + "logs" + string(os.PathSeparator) + "access.log"
 var ErrorLogFile = GetDataDirectory() + string(os.PathSeparator) + "logs" + string(os.PathSeparator) + "error.log"
 var WafLogFile = GetDataDirectory() + string(os.PathSeparator) + "logs" + string(os.PathSeparator) + "waf.log"
+var MirrorLogFile = GetDataDirectory() + string(os.PathSeparator) + "logs" + string(os.PathSeparator) + "mirror.log"
 
 func RequestLog(method, url, protocol, host string) {
 	line := method + " " + url + " " + protocol + " - Host: " + host
@@ -30,6 +31,8 @@ func AppendLog(logType, entry string) {
 		file = ErrorLogFile
 	} else if logType == "waf" {
 		file = WafLogFile
+	} else if logType == "mirror" {
+		file = MirrorLogFile
 	}
 	// Ensure the log directory exists
 	logDir := GetDataDirectory() + string(os.PathSeparator) + "logs"
@@ -24,23 +24,43 @@ func handleConnection(conn net.Conn, hosts []Host) {
 
 	var request HttpRequest
 	var err error
+	var tlsVersion string
+	_ = conn.SetReadDeadline(time.Now().Add(ClientTimeout()))
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		if err = tlsConn.Handshake(); err != nil {
 			ErrorLog(err)
 			return
 		}
 		state := tlsConn.ConnectionState()
+		tlsVersion = tls.VersionName(state.Version)
 		alpn := state.NegotiatedProtocol // "h2" for HTTP/2, "http/1.1" for HTTP/1.1
-		request, err = ReadRequest(conn, alpn)
+		request, err = ReadRequestHead(conn, alpn)
 	} else {
-		request, err = ReadRequest(conn, "")
+		request, err = ReadRequestHead(conn, "")
 	}
 
 	if err != nil {
 		ErrorLog(err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// Only answer if the request line was received, otherwise just close the connection
+			ServeError(conn, request, 408)
+		}
 		return
 	}
-	remoteIp := conn.RemoteAddr().String()
+	request.ID = NewRequestID()
+	request.TLSVersion = tlsVersion
+	request.RemoteAddr = conn.RemoteAddr().String()
+	request.ClientIP = ResolveClientIP(GetLocalIpWithoutPort(request.RemoteAddr), request.Headers)
+	request.LocalAddr = conn.LocalAddr().String()
+	request.ProxyProtocol = GetProxyProtocolHeader(conn)
+	if request.ProxyProtocol != nil && request.ProxyProtocol.DestinationAddr != nil {
+		request.LocalAddr = request.ProxyProtocol.DestinationAddr.String()
+	}
+	request.Scheme = "http"
+	if _, ok := conn.(*tls.Conn); ok {
+		request.Scheme = "https"
+	}
 	host := request.Headers["host"]
 	if host == "" {
 		ServeError(conn, request, 400)
@@ -48,9 +68,27 @@ func handleConnection(conn net.Conn, hosts []Host) {
 	}
 	matchedHost := FindHost(hosts, host)
 	if matchedHost == nil {
-		ServeResponse(conn, request, ResponseServed{Status: 200, Body: FallbackHtml()})
+		ServeUnmatchedHost(conn, request)
+		return
+	}
+	// The body is read according to the location, so that it can be rejected before it is received. Requests
+	// without a location are answered before reading their body, which nothing limits.
+	bodyLocation, _ := matchedHost.FindLocation(request.Path)
+	if bodyLocation == nil {
+		RequestLog(request.Method, request.Path, request.Version, request.ClientIP)
+		ServeError(conn, request, 404)
 		return
 	}
+	if status, err := ReadRequestBody(conn, &request, bodyLocation); err != nil {
+		ErrorLog(err)
+		RequestLog(request.Method, request.Path, request.Version, request.ClientIP)
+		ServeError(conn, request, status)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if request.BodySource != nil {
+		defer request.BodySource.Close()
+	}
 	waf := MakeWAFChecks(request)
 	if waf.Blocked {
 		if waf.CloseConnection {
@@ -73,7 +111,7 @@ func handleConnection(conn net.Conn, hosts []Host) {
 			}
 			// Data to be used in the captcha page to identify the request.
 			data := make(map[string]string)
-			data["ip"] = GetLocalIpWithoutPort(remoteIp)
+			data["ip"] = request.ClientIP
 			data["user_agent"] = request.Headers["user-agent"]
 			data["host"] = host
 			data["path"] = request.Path
@@ -96,280 +134,309 @@ func handleConnection(conn net.Conn, hosts []Host) {
 		request.Method = waf.ModifiedRequest.Method
 		request.Path = waf.ModifiedRequest.Path
 	}
-	RequestLog(request.Method, request.Path, request.Version, remoteIp)
-
-	if matchedHost.Domain == host {
-		for _, location := range matchedHost.Locations {
-			if IsLocationMatching(location.Match, request.Path) {
-				cacheDuration := matchedHost.EdgeCache.Duration
-				isCacheable := matchedHost.EdgeCache.Enabled && IsEdgeCacheEligible(request.Path, matchedHost.EdgeCache.Extensions)
 
-				if isCacheable {
-					if data, found := GetFileFromEdgeCache(request.Path); found {
-						mimeType := mime.TypeByExtension(filepath.Ext(request.Path))
-						if mimeType == "" {
-							mimeType = "application/octet-stream"
-						}
-
-						headers := PopulateHeaders(location.Headers, &data.Headers)
-						lastModified := data.Headers["last-modified"]
-						headers["x-cache"] = "HIT"
-						headers["age"] = strconv.FormatFloat(time.Since(data.AddedAt).Seconds(), 'f', 0, 64)
-
-						if waf.ClearanceToken != nil {
-							headers["set-cookie"] = SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true)
-						}
-
-						ifModifiedSince := request.Headers["if-modified-since"]
-						if ifModifiedSince != "" && ifModifiedSince == lastModified {
-							headers["last-modified"] = lastModified
-							ServeResponse(conn, request, ResponseServed{
-								Status:  304,
-								Body:    "",
-								Headers: headers,
-							})
-							return
-						}
-
-						rangeHeader := request.Headers["range"]
-						if strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") {
-							headers["accept-ranges"] = "bytes"
-							if rangeHeader != "" {
-								dataLength := int64(len(data.Data))
-								start, end, err := GetRangeStartEnd(rangeHeader, dataLength)
-								if err != nil {
-									ErrorLog(err)
-									ServeError(conn, request, 416)
-									return
-								}
-
-								body := data.Data[start : end+1]
-								headers["content-range"] = fmt.Sprintf("bytes %d-%d/%d", start, end, dataLength)
-								ServeResponse(conn, request, ResponseServed{
-									Status:      206,
-									Body:        string(body),
-									ContentType: &mimeType,
-									Headers:     headers,
-								})
-								return
-							}
-						}
-
-						ServeResponse(conn, request, ResponseServed{
-							Status:      200,
-							Body:        string(data.Data),
-							ContentType: &mimeType,
-							Headers:     headers,
-						})
-						return
-					}
-				}
-
-				if location.Content != nil {
-					body := *location.Content
-					variables := map[string]string{
-						"user_agent":  request.Headers["user-agent"],
-						"remote_addr": GetLocalIpWithoutPort(remoteIp),
-						"host":        host,
-						"path":        request.Path,
-						"method":      request.Method,
-						"scheme":      "http",
-					}
-					for key, value := range variables {
-						placeholder := fmt.Sprintf("$%s", key)
-						body = strings.ReplaceAll(body, placeholder, value)
-					}
-					ServeResponse(conn, request, ResponseServed{Status: 200, Body: body})
-					return
-				} else if location.Root != nil {
-					stat, err := os.Stat(*location.Root)
-					if err != nil || !stat.IsDir() {
-						if err != nil {
-							ErrorLog(err)
-						}
-						ServeError(conn, request, 500)
-						return
-					}
+	matchedLocation, captures := matchedHost.FindLocation(request.Path)
+	if matchedLocation == nil {
+		RequestLog(request.Method, request.Path, request.Version, request.ClientIP)
+		ServeError(conn, request, 404)
+		return
+	}
+	location := *matchedLocation
+	request.LocationCaptures = captures
+	request.Path = location.Rewrite.Apply(request.Path, captures)
+	RequestLog(request.Method, request.Path, request.Version, request.ClientIP)
+	variables := RequestVariables(request, location)
+	respond := func(resp ResponseServed) {
+		if resp.Headers == nil {
+			resp.Headers = make(map[string]string)
+		}
+		location.ApplyResponseHeaderRules(resp.Headers, variables)
+		ServeResponse(conn, request, resp)
+	}
+	cacheDuration := matchedHost.EdgeCache.Duration
+	isCacheable := matchedHost.EdgeCache.Enabled && IsEdgeCacheEligible(request.Path, matchedHost.EdgeCache.Extensions)
+
+	if isCacheable {
+		if data, found := GetFileFromEdgeCache(request.Path); found {
+			mimeType := mime.TypeByExtension(filepath.Ext(request.Path))
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
 
-					unesc, err := url.QueryUnescape(request.Path[1:])
-					if err != nil {
-						ServeError(conn, request, 400)
-						return
-					}
-					filePath := *location.Root + string(os.PathSeparator) + unesc
-					stat, err = os.Stat(filePath)
-					if err != nil || stat.IsDir() {
-						ServeError(conn, request, 404)
-						return
-					}
+			headers := PopulateHeaders(location.Headers, &data.Headers)
+			lastModified := data.Headers["last-modified"]
+			headers["x-cache"] = "HIT"
+			headers["age"] = strconv.FormatFloat(time.Since(data.AddedAt).Seconds(), 'f', 0, 64)
 
-					data, err := os.ReadFile(filePath)
-					if err != nil {
-						if errors.Is(err, os.ErrNotExist) {
-							ErrorLog(err)
-							ServeError(conn, request, 404)
-						} else if errors.Is(err, os.ErrPermission) {
-							ErrorLog(err)
-							ServeError(conn, request, 403)
-						} else if errors.Is(err, os.ErrInvalid) {
-							ErrorLog(err)
-							ServeError(conn, request, 400)
-						} else {
-							ErrorLog(err)
-							ServeError(conn, request, 500)
-						}
-						return
-					}
+			if waf.ClearanceToken != nil {
+				headers["set-cookie"] = SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true, "")
+			}
 
-					lastModified := stat.ModTime().UTC().Format(HttpDateFormat)
-					ext := filepath.Ext(filePath)
-					mimeType := mime.TypeByExtension(ext)
-					if mimeType == "" {
-						mimeType = "application/octet-stream"
-					}
-					headers := PopulateHeaders(location.Headers)
-					headers["last-modified"] = lastModified
-
-					rangeHeader := request.Headers["range"]
-					if strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") {
-						headers["accept-ranges"] = "bytes"
-						if rangeHeader != "" {
-							start, end, err := GetRangeStartEnd(rangeHeader, stat.Size())
-							if err != nil {
-								ErrorLog(err)
-								ServeError(conn, request, 416)
-								return
-							}
-
-							if isCacheable {
-								headers["x-cache"] = "MISS"
-								err = AddFileToEdgeCache(EdgeCacheFile{
-									Data:     data,
-									Duration: time.Duration(cacheDuration) * time.Second,
-									Path:     request.Path,
-									Headers:  headers,
-								})
-								if err != nil {
-									ErrorLog(err)
-									ServeError(conn, request, 500)
-									return
-								}
-							}
-
-							data = data[start : end+1]
-							headers["content-range"] = fmt.Sprintf("bytes %d-%d/%d", start, end, stat.Size())
-							if waf.ClearanceToken != nil {
-								headers["set-cookie"] = SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true)
-							}
-							ServeResponse(conn, request, ResponseServed{
-								Status:      206,
-								Body:        string(data),
-								ContentType: &mimeType,
-								Headers:     headers,
-							})
-							return
-						}
-					}
+			ifModifiedSince := request.Headers["if-modified-since"]
+			if ifModifiedSince != "" && ifModifiedSince == lastModified {
+				headers["last-modified"] = lastModified
+				respond(ResponseServed{
+					Status:  304,
+					Body:    "",
+					Headers: headers,
+				})
+				return
+			}
 
-					if isCacheable {
-						headers["x-cache"] = "MISS"
-						err = AddFileToEdgeCache(EdgeCacheFile{
-							Data:     data,
-							Duration: time.Duration(cacheDuration) * time.Second,
-							Path:     request.Path,
-							Headers:  headers,
-						})
+			rangeHeader := request.Headers["range"]
+			if strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") {
+				headers["accept-ranges"] = "bytes"
+				if rangeHeader != "" {
+					content := data.Data
+					if data.Encoding != "" {
+						// Ranges apply to the decompressed content
+						content, err = DecompressBody(data.Data, data.Encoding)
 						if err != nil {
 							ErrorLog(err)
 							ServeError(conn, request, 500)
 							return
 						}
 					}
-
-					if request.Headers["if-modified-since"] == lastModified {
-						headers := PopulateHeaders(location.Headers)
-						if waf.ClearanceToken != nil {
-							headers["set-cookie"] = SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true)
-						}
-						headers["last-modified"] = lastModified
-						ServeResponse(conn, request, ResponseServed{
-							Status:  304,
-							Body:    "",
-							Headers: headers,
-						})
+					dataLength := int64(len(content))
+					start, end, err := GetRangeStartEnd(rangeHeader, dataLength)
+					if err != nil {
+						ErrorLog(err)
+						ServeError(conn, request, 416)
 						return
 					}
 
-					ServeResponse(conn, request, ResponseServed{
-						Status:      200,
-						Body:        string(data),
+					body := content[start : end+1]
+					headers["content-range"] = fmt.Sprintf("bytes %d-%d/%d", start, end, dataLength)
+					respond(ResponseServed{
+						Status:      206,
+						Body:        string(body),
 						ContentType: &mimeType,
 						Headers:     headers,
 					})
 					return
-				} else if location.Proxy != nil {
-					response, err := MakeProxyRequest(conn, request, *location.Proxy)
+				}
+			}
+
+			respond(ResponseServed{
+				Status:          200,
+				Body:            string(data.Data),
+				ContentType:     &mimeType,
+				Headers:         headers,
+				ContentEncoding: data.Encoding,
+			})
+			return
+		}
+	}
+
+	if location.Content != nil {
+		body := ExpandVariables(*location.Content, variables)
+		respond(ResponseServed{Status: 200, Body: body})
+		return
+	} else if location.FastCGI != nil {
+		response, kind, err := MakeFastCGIRequest(request, location)
+		if err != nil {
+			ErrorLog(err)
+			if kind == RetryOnTimeout {
+				ServeError(conn, request, 504)
+			} else {
+				ServeError(conn, request, 502)
+			}
+			return
+		}
+		contentType := response.Headers["content-type"]
+		respond(ResponseServed{
+			Status:      response.Status,
+			Body:        response.Body,
+			ContentType: &contentType,
+			Headers:     response.Headers,
+		})
+		return
+	} else if location.Root != nil {
+		stat, err := os.Stat(*location.Root)
+		if err != nil || !stat.IsDir() {
+			if err != nil {
+				ErrorLog(err)
+			}
+			ServeError(conn, request, 500)
+			return
+		}
+
+		unesc, err := url.QueryUnescape(request.Path[1:])
+		if err != nil {
+			ServeError(conn, request, 400)
+			return
+		}
+		filePath := *location.Root + string(os.PathSeparator) + unesc
+		stat, err = os.Stat(filePath)
+		if err != nil || stat.IsDir() {
+			ServeError(conn, request, 404)
+			return
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				ErrorLog(err)
+				ServeError(conn, request, 404)
+			} else if errors.Is(err, os.ErrPermission) {
+				ErrorLog(err)
+				ServeError(conn, request, 403)
+			} else if errors.Is(err, os.ErrInvalid) {
+				ErrorLog(err)
+				ServeError(conn, request, 400)
+			} else {
+				ErrorLog(err)
+				ServeError(conn, request, 500)
+			}
+			return
+		}
+
+		lastModified := stat.ModTime().UTC().Format(HttpDateFormat)
+		ext := filepath.Ext(filePath)
+		mimeType := mime.TypeByExtension(ext)
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		headers := PopulateHeaders(location.Headers)
+		headers["last-modified"] = lastModified
+
+		rangeHeader := request.Headers["range"]
+		if strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") {
+			headers["accept-ranges"] = "bytes"
+			if rangeHeader != "" {
+				start, end, err := GetRangeStartEnd(rangeHeader, stat.Size())
+				if err != nil {
+					ErrorLog(err)
+					ServeError(conn, request, 416)
+					return
+				}
+
+				if isCacheable {
+					headers["x-cache"] = "MISS"
+					err = AddFileToEdgeCache(EdgeCacheFile{
+						Data:     data,
+						Duration: time.Duration(cacheDuration) * time.Second,
+						Path:     request.Path,
+						Headers:  headers,
+					})
 					if err != nil {
 						ErrorLog(err)
-						return
-					}
-					if response.Headers == nil {
 						ServeError(conn, request, 500)
 						return
 					}
+				}
 
-					cacheControl := response.Headers["cache-control"]
-					if cacheControl != "" {
-						parts := strings.Split(cacheControl, ",")
-						for _, part := range parts {
-							part = strings.TrimSpace(part)
-							if part == "no-store" || part == "no-cache" || part == "private" {
-								isCacheable = false
-								break
-							} else if strings.HasPrefix(part, "max-age=") {
-								ageStr := strings.TrimPrefix(part, "max-age=")
-								age, err := strconv.Atoi(ageStr)
-								if err == nil && age < cacheDuration {
-									cacheDuration = age
-								}
-							}
-						}
-					}
-					if isCacheable && response.Status == 200 {
-						if _, found := GetFileFromEdgeCache(request.Path); !found {
-							response.Headers["x-cache"] = "MISS"
-							err = AddFileToEdgeCache(EdgeCacheFile{
-								Data:     []byte(response.Body),
-								Duration: time.Duration(cacheDuration) * time.Second,
-								Path:     request.Path,
-								Headers:  response.Headers,
-							})
-						}
-					}
+				data = data[start : end+1]
+				headers["content-range"] = fmt.Sprintf("bytes %d-%d/%d", start, end, stat.Size())
+				if waf.ClearanceToken != nil {
+					headers["set-cookie"] = SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true, "")
+				}
+				respond(ResponseServed{
+					Status:      206,
+					Body:        string(data),
+					ContentType: &mimeType,
+					Headers:     headers,
+				})
+				return
+			}
+		}
 
-					contentType, _ := response.Headers["content-type"]
-					if waf.ClearanceToken != nil {
-						response.Headers["set-cookie"] = SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true)
+		if isCacheable {
+			headers["x-cache"] = "MISS"
+			err = AddFileToEdgeCache(EdgeCacheFile{
+				Data:     data,
+				Duration: time.Duration(cacheDuration) * time.Second,
+				Path:     request.Path,
+				Headers:  headers,
+			})
+			if err != nil {
+				ErrorLog(err)
+				ServeError(conn, request, 500)
+				return
+			}
+		}
+
+		if request.Headers["if-modified-since"] == lastModified {
+			headers := PopulateHeaders(location.Headers)
+			if waf.ClearanceToken != nil {
+				headers["set-cookie"] = SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true, "")
+			}
+			headers["last-modified"] = lastModified
+			respond(ResponseServed{
+				Status:  304,
+				Body:    "",
+				Headers: headers,
+			})
+			return
+		}
+
+		respond(ResponseServed{
+			Status:      200,
+			Body:        string(data),
+			ContentType: &mimeType,
+			Headers:     headers,
+		})
+		return
+	} else if location.IsProxy() {
+		response, err := MakeProxyRequest(conn, request, location)
+		if err != nil {
+			ErrorLog(err)
+			return
+		}
+		if response.Headers == nil {
+			ServeError(conn, request, 500)
+			return
+		}
+
+		cacheControl := response.Headers["cache-control"]
+		if cacheControl != "" {
+			parts := strings.Split(cacheControl, ",")
+			for _, part := range parts {
+				part = strings.TrimSpace(part)
+				if part == "no-store" || part == "no-cache" || part == "private" {
+					isCacheable = false
+					break
+				} else if strings.HasPrefix(part, "max-age=") {
+					ageStr := strings.TrimPrefix(part, "max-age=")
+					age, err := strconv.Atoi(ageStr)
+					if err == nil && age < cacheDuration {
+						cacheDuration = age
 					}
-					ServeResponse(conn, request, ResponseServed{
-						Status:      response.Status,
-						Body:        response.Body,
-						ContentType: &contentType,
-						Headers:     response.Headers,
-					})
-					return
 				}
-			} else {
-				ServeError(conn, request, 404)
-				return
 			}
 		}
-	} else {
+		if isCacheable && response.Status == 200 && response.Stream == nil {
+			if _, found := GetFileFromEdgeCache(request.Path); !found {
+				response.Headers["x-cache"] = "MISS"
+				err = AddFileToEdgeCache(EdgeCacheFile{
+					Data:     []byte(response.Body),
+					Duration: time.Duration(cacheDuration) * time.Second,
+					Path:     request.Path,
+					Headers:  response.Headers,
+					Encoding: response.Headers["content-encoding"],
+				})
+			}
+		}
+
+		contentType, _ := response.Headers["content-type"]
+		if waf.ClearanceToken != nil {
+			AppendHeader(response.Headers, "set-cookie", SetCookie("iridium_clearance", *waf.ClearanceToken, StrPtr("/"), nil, IntPtr(int(clearanceMaxAge.Seconds())), false, true, ""))
+		}
+		respond(ResponseServed{
+			Status:          response.Status,
+			Body:            response.Body,
+			ContentType:     &contentType,
+			Headers:         response.Headers,
+			ContentEncoding: response.Headers["content-encoding"],
+			Stream:          response.Stream,
+		})
 		return
 	}
 }
 
-func StartListener() (net.Listener, error) {
+// StartListener starts listening for HTTP connections, or for HTTPS connections if TLS is configured. TLS connections
+// of hosts with TLS passthrough are forwarded to their upstreams.
+func StartListener(hosts *HostStore) (net.Listener, error) {
 	tlsCertFile := GetConfigValue("tls.cert_file", "").(string)
 	tlsKeyFile := GetConfigValue("tls.key_file", "").(string)
 
@@ -388,7 +455,11 @@ func StartListener() (net.Listener, error) {
 		if err != nil {
 			return nil, err
 		}
-		tlsListener := tls.NewListener(httpsListener, tlsConfig)
+		tlsListener, err := NewSNIRouterListener(WrapProxyProtocolListener(httpsListener), tlsConfig, hosts)
+		if err != nil {
+			httpsListener.Close()
+			return nil, err
+		}
 		println("Iridium is running on port 443")
 		return tlsListener, nil
 	}
@@ -398,7 +469,7 @@ func StartListener() (net.Listener, error) {
 		return nil, err
 	}
 	println("Iridium is running on port 80")
-	return listener, nil
+	return WrapProxyProtocolListener(listener), nil
 }
 
 func main() {
@@ -457,7 +528,18 @@ func main() {
 		return
 	}
 
-	listener, err := StartListener()
+	if err := PrepareConfig(); err != nil {
+		panic("Invalid configuration: " + err.Error())
+	}
+	hosts, err := LoadHosts()
+	if err != nil {
+		panic("Failed to load hosts:" + err.Error())
+	}
+	fmt.Printf("Loaded %d host(s)\n", len(hosts))
+	store := NewHostStore(hosts)
+	StartDiscovery(store, LoadDiscoveryProviders())
+
+	listener, err := StartListener(store)
 	if err != nil {
 		if errors.Is(err, net.ErrClosed) {
 			println("Network is closed")
@@ -465,12 +547,11 @@ func main() {
 			println("Error occurred:", err.Error())
 		}
 	}
-
-	hosts, err := LoadHosts()
+	streams, err := LoadStreams()
 	if err != nil {
-		panic("Failed to load hosts:" + err.Error())
+		println("Failed to load streams:", err.Error())
 	}
-	fmt.Printf("Loaded %d host(s)\n", len(hosts))
+	StartStreams(streams)
 	defer listener.Close()
 
 	for {
@@ -483,6 +564,6 @@ func main() {
 			println("Error accepting connection:", err.Error())
 			continue
 		}
-		go handleConnection(conn, hosts)
+		go handleConnection(conn, store.Hosts())
 	}
 }
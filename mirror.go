@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// MirrorConfig sends a copy of the proxied requests of a location to shadow upstreams, e.g. to test a new version of a
+// service with real traffic. Mirrored responses are discarded, and never delay the response sent to the client.
+type MirrorConfig struct {
+	// Shadow upstreams receiving a copy of each mirrored request, e.g. "http://10.0.0.9:8080".
+	Upstreams []string `yaml:"upstreams"`
+	// Percentage of requests that are mirrored, from 0 (mirroring is disabled) to 100. Default is 100.
+	Percentage *float64 `yaml:"percentage,omitempty"`
+	// Maximum duration of mirrored requests, in seconds. Default is 10 seconds.
+	Timeout int `yaml:"timeout,omitempty"`
+}
+
+// Sample reports whether a request must be mirrored.
+func (mirror *MirrorConfig) Sample() bool {
+	if mirror == nil || len(mirror.Upstreams) == 0 {
+		return false
+	}
+	if mirror.Percentage == nil || *mirror.Percentage >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < *mirror.Percentage
+}
+
+func (mirror *MirrorConfig) timeout() time.Duration {
+	if mirror.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(mirror.Timeout) * time.Second
+}
+
+// MirrorRequest sends the proxy request to every shadow upstream of the location, in the background.
+func MirrorRequest(proxyRequest HttpRequest, request HttpRequest, location HostLocation) {
+	mirror := location.Mirror
+	// Mirrored responses are discarded, there is no need to rewrite them
+	location.Substitutions = nil
+	location.Streaming = false
+	location.Retry = nil
+	for _, upstream := range mirror.Upstreams {
+		if proxyRequest.BodySource != nil {
+			// The body is released when the client request is done, which may happen before the mirrored request
+			proxyRequest.BodySource.Retain()
+		}
+		go func() {
+			if proxyRequest.BodySource != nil {
+				defer proxyRequest.BodySource.Close()
+			}
+			start := time.Now()
+			response, _, err := sendProxyRequest(proxyRequest, location, upstream, mirror.timeout())
+			if response.Stream != nil {
+				response.Stream.Close()
+			}
+			MirrorLog(request, "mirror", upstream, response.Status, time.Since(start), err)
+		}()
+	}
+}
+
+// MirrorLog records the outcome of a mirrored request, or of the request it was copied from, in the mirror log.
+func MirrorLog(request HttpRequest, kind, upstream string, status int, latency time.Duration, err error) {
+	outcome := fmt.Sprintf("%d", status)
+	if err != nil {
+		outcome = "error (" + err.Error() + ")"
+	}
+	AppendLog("mirror", fmt.Sprintf("%s %s %s %s -> %s: %s in %dms", request.ID, kind, request.Method, request.Path,
+		upstream, outcome, latency.Milliseconds()))
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+PROXY protocol as defined in https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+Version 1 is a single text line sent before any data, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+Version 2 is a binary header starting with a 12-byte signature, followed by the addresses and optional TLV fields.
+*/
+
+const (
+	proxyProtocolV1Prefix = "PROXY "
+	proxyProtocolV1MaxLen = 107
+	// Time allowed for the peer to send the PROXY protocol header.
+	proxyProtocolReadTimeout = 5 * time.Second
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// TLV types of PROXY protocol v2 headers.
+const (
+	ProxyProtocolTLVALPN      byte = 0x01
+	ProxyProtocolTLVAuthority byte = 0x02
+	ProxyProtocolTLVSSL       byte = 0x20
+	ProxyProtocolTLVNetNS     byte = 0x30
+)
+
+// ProxyProtocolHeader is a parsed PROXY protocol header.
+type ProxyProtocolHeader struct {
+	Version int
+	// Address of the original client. Nil if the proxy sent an UNKNOWN or LOCAL header.
+	SourceAddr net.Addr
+	// Address the original client connected to.
+	DestinationAddr net.Addr
+	// TLV fields of version 2 headers, by type.
+	TLVs map[byte][]byte
+}
+
+// Authority returns the host name the client connected to (usually the TLS SNI), if the proxy sent it.
+func (header *ProxyProtocolHeader) Authority() string {
+	if header == nil {
+		return ""
+	}
+	return string(header.TLVs[ProxyProtocolTLVAuthority])
+}
+
+// ReadProxyProtocolHeader reads a version 1 or version 2 PROXY protocol header from the reader.
+func ReadProxyProtocolHeader(reader *bufio.Reader) (*ProxyProtocolHeader, error) {
+	prefix, err := reader.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if string(prefix) == proxyProtocolV1Prefix {
+		return readProxyProtocolV1(reader)
+	}
+
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if !bytes.Equal(signature, proxyProtocolV2Signature) {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	return readProxyProtocolV2(reader)
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (*ProxyProtocolHeader, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte(CRLF)) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if len(line) > proxyProtocolV1MaxLen {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+	}
+
+	header := &ProxyProtocolHeader{Version: 1}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", strings.TrimSpace(string(line)))
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.Atoi(fields[4])
+	dstPort, err2 := strconv.Atoi(fields[5])
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", strings.TrimSpace(string(line)))
+	}
+	header.SourceAddr = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	header.DestinationAddr = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return header, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (*ProxyProtocolHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0F
+	family := fixed[13] >> 4
+	transport := fixed[13] & 0x0F
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	header := &ProxyProtocolHeader{Version: 2, TLVs: make(map[byte][]byte)}
+	var addrLen int
+	switch family {
+	case 0x1: // AF_INET
+		addrLen = 12
+	case 0x2: // AF_INET6
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	}
+	if len(payload) < addrLen {
+		return nil, errors.New("PROXY protocol v2 header is too short")
+	}
+
+	// Command 0x0 is LOCAL (e.g. health checks from the proxy itself), whose addresses must be ignored
+	if command == 0x1 && (family == 0x1 || family == 0x2) {
+		ipLen := (addrLen - 4) / 2
+		srcIP := net.IP(payload[:ipLen])
+		dstIP := net.IP(payload[ipLen : 2*ipLen])
+		srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+		if transport == 0x2 {
+			header.SourceAddr = &net.UDPAddr{IP: srcIP, Port: srcPort}
+			header.DestinationAddr = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		} else {
+			header.SourceAddr = &net.TCPAddr{IP: srcIP, Port: srcPort}
+			header.DestinationAddr = &net.TCPAddr{IP: dstIP, Port: dstPort}
+		}
+	}
+
+	tlvs := payload[addrLen:]
+	for len(tlvs) >= 3 {
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, errors.New("malformed PROXY protocol v2 TLV")
+		}
+		header.TLVs[tlvs[0]] = tlvs[3 : 3+length]
+		tlvs = tlvs[3+length:]
+	}
+	return header, nil
+}
+
+// ProxyProtocolConn is a connection whose first bytes are a PROXY protocol header. The header is read on the first call
+// to Read or RemoteAddr, so that reading it never blocks the accept loop.
+type ProxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	header *ProxyProtocolHeader
+	err    error
+	// Read deadline set by the user of the connection, restored once the header is read.
+	readDeadline time.Time
+}
+
+func NewProxyProtocolConn(conn net.Conn) *ProxyProtocolConn {
+	return &ProxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (conn *ProxyProtocolConn) readHeader() {
+	conn.once.Do(func() {
+		_ = conn.Conn.SetReadDeadline(time.Now().Add(proxyProtocolReadTimeout))
+		conn.header, conn.err = ReadProxyProtocolHeader(conn.reader)
+		_ = conn.Conn.SetReadDeadline(conn.readDeadline)
+		if conn.err != nil {
+			ErrorLog(fmt.Errorf("invalid PROXY protocol header from %s: %v", conn.Conn.RemoteAddr(), conn.err))
+		}
+	})
+}
+
+func (conn *ProxyProtocolConn) Read(b []byte) (int, error) {
+	conn.readHeader()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.reader.Read(b)
+}
+
+func (conn *ProxyProtocolConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline = t
+	return conn.Conn.SetReadDeadline(t)
+}
+
+func (conn *ProxyProtocolConn) SetDeadline(t time.Time) error {
+	conn.readDeadline = t
+	return conn.Conn.SetDeadline(t)
+}
+
+// RemoteAddr returns the address of the original client sent in the PROXY protocol header.
+func (conn *ProxyProtocolConn) RemoteAddr() net.Addr {
+	conn.readHeader()
+	if conn.header != nil && conn.header.SourceAddr != nil {
+		return conn.header.SourceAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+// Header returns the PROXY protocol header, or nil if it could not be read.
+func (conn *ProxyProtocolConn) Header() *ProxyProtocolHeader {
+	conn.readHeader()
+	return conn.header
+}
+
+// ProxyProtocolListener expects a PROXY protocol header on connections from trusted peers.
+// Connections from other peers are returned unchanged.
+type ProxyProtocolListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+}
+
+func (listener *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !IsIPInList(GetLocalIpWithoutPort(conn.RemoteAddr().String()), listener.Trusted) {
+		return conn, nil
+	}
+	return NewProxyProtocolConn(conn), nil
+}
+
+// proxyProtocolTrusted are the networks of "server.proxy_protocol.trusted_cidrs", loaded at startup by
+// LoadProxyProtocolTrusted.
+var proxyProtocolTrusted []*net.IPNet
+
+// LoadProxyProtocolTrusted parses "server.proxy_protocol.trusted_cidrs" once, for every listener.
+func LoadProxyProtocolTrusted() error {
+	networks, err := ParseCIDRList(GetConfigStringList("server.proxy_protocol.trusted_cidrs"))
+	if err != nil {
+		return fmt.Errorf("server.proxy_protocol.trusted_cidrs: %v", err)
+	}
+	proxyProtocolTrusted = networks
+	return nil
+}
+
+// WrapProxyProtocolListener enables PROXY protocol on the listener if "server.proxy_protocol.enabled" is set.
+func WrapProxyProtocolListener(listener net.Listener) net.Listener {
+	if !GetConfigValue("server.proxy_protocol.enabled", false).(bool) {
+		return listener
+	}
+	return &ProxyProtocolListener{Listener: listener, Trusted: proxyProtocolTrusted}
+}
+
+// GetProxyProtocolHeader returns the PROXY protocol header received on the connection, if any.
+// Wrapping connections, such as TLS connections, are unwrapped to find it.
+func GetProxyProtocolHeader(conn net.Conn) *ProxyProtocolHeader {
+	for {
+		if ppConn, ok := conn.(*ProxyProtocolConn); ok {
+			return ppConn.Header()
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// EncodeProxyProtocolHeader builds a version 1 or version 2 PROXY protocol header carrying the given addresses.
+// If the addresses are missing or of different families, an UNKNOWN (v1) or LOCAL (v2) header is built.
+func EncodeProxyProtocolHeader(version int, source, destination net.Addr) []byte {
+	srcIP, srcPort, udp := splitProxyProtocolAddr(source)
+	dstIP, dstPort, _ := splitProxyProtocolAddr(destination)
+	if srcIP != nil && dstIP != nil && (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		// Mixed families, send both as IPv6
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	} else if srcIP != nil && dstIP != nil && srcIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+
+	if version == 1 {
+		if srcIP == nil || dstIP == nil || udp {
+			return []byte("PROXY UNKNOWN" + CRLF)
+		}
+		family, src, dst := "TCP4", srcIP.String(), dstIP.String()
+		if len(srcIP) == net.IPv6len {
+			// IPv4 addresses are written in their IPv4-mapped form, e.g. "::ffff:1.2.3.4", since receivers expect
+			// IPv6 addresses only
+			srcAddr, _ := netip.AddrFromSlice(srcIP)
+			dstAddr, _ := netip.AddrFromSlice(dstIP)
+			family, src, dst = "TCP6", srcAddr.String(), dstAddr.String()
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src, dst, srcPort, dstPort)
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+	if srcIP == nil || dstIP == nil {
+		// LOCAL command, without addresses
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+	family := byte(0x10)
+	if len(srcIP) == net.IPv6len {
+		family = 0x20
+	}
+	transport := byte(0x1)
+	if udp {
+		transport = 0x2
+	}
+	header.Write([]byte{0x21, family | transport})
+	_ = binary.Write(&header, binary.BigEndian, uint16(2*len(srcIP)+4))
+	header.Write(srcIP)
+	header.Write(dstIP)
+	_ = binary.Write(&header, binary.BigEndian, uint16(srcPort))
+	_ = binary.Write(&header, binary.BigEndian, uint16(dstPort))
+	return header.Bytes()
+}
+
+func splitProxyProtocolAddr(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			return a.IP, a.Port, false
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			return a.IP, a.Port, true
+		}
+	}
+	return nil, 0, false
+}
+
+// ParseProxyProtocolVersion parses a "v1" or "v2" setting. An empty setting returns 0, meaning disabled.
+func ParseProxyProtocolVersion(setting string) (int, error) {
+	switch strings.ToLower(setting) {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unsupported PROXY protocol version: %s", setting)
+}
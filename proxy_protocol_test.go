@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestEncodeProxyProtocolHeaderV1(t *testing.T) {
+	tcp := func(ip string, port int) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	tests := []struct {
+		name             string
+		source, dest     net.Addr
+		want             string
+		wantSrc, wantDst string
+	}{
+		{"IPv4", tcp("192.0.2.1", 56324), tcp("198.51.100.1", 443), "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1", "198.51.100.1"},
+		{"IPv6", tcp("2001:db8::1", 56324), tcp("::1", 443), "PROXY TCP6 2001:db8::1 ::1 56324 443\r\n", "2001:db8::1", "::1"},
+		{"IPv4 to IPv6", tcp("1.2.3.4", 1), tcp("::1", 2), "PROXY TCP6 ::ffff:1.2.3.4 ::1 1 2\r\n", "1.2.3.4", "::1"},
+		{"IPv6 to IPv4", tcp("2001:db8::1", 1), tcp("10.0.0.1", 2), "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 1 2\r\n", "2001:db8::1", "10.0.0.1"},
+		{"unknown source", nil, tcp("10.0.0.1", 2), "PROXY UNKNOWN\r\n", "", ""},
+		{"UDP", &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1}, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}, "PROXY UNKNOWN\r\n", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := EncodeProxyProtocolHeader(1, test.source, test.dest)
+			if string(encoded) != test.want {
+				t.Fatalf("EncodeProxyProtocolHeader() = %q, want %q", encoded, test.want)
+			}
+			header, err := ReadProxyProtocolHeader(bufio.NewReader(bytes.NewReader(encoded)))
+			if err != nil {
+				t.Fatalf("ReadProxyProtocolHeader() returned error: %v", err)
+			}
+			if test.wantSrc == "" {
+				if header.SourceAddr != nil {
+					t.Errorf("SourceAddr = %v, want none", header.SourceAddr)
+				}
+				return
+			}
+			src, dst := header.SourceAddr.(*net.TCPAddr), header.DestinationAddr.(*net.TCPAddr)
+			if !src.IP.Equal(net.ParseIP(test.wantSrc)) || !dst.IP.Equal(net.ParseIP(test.wantDst)) {
+				t.Errorf("addresses = %v, %v, want %s, %s", src, dst, test.wantSrc, test.wantDst)
+			}
+		})
+	}
+}
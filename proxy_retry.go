@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Conditions that can trigger a retry of a proxied request. Status codes (e.g. "502") can also be used.
+const (
+	RetryOnConnectFailure = "connect_failure"
+	RetryOnReset          = "reset"
+	RetryOnTimeout        = "timeout"
+)
+
+// IdempotentMethods are the methods that are retried when RetryConfig.Methods is empty.
+var IdempotentMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE"}
+
+type RetryConfig struct {
+	// Maximum number of attempts, including the first one. Default is 1 (no retries).
+	Attempts int `yaml:"attempts"`
+	// Conditions that trigger a retry: connect_failure, reset, timeout, or upstream status codes such as 502.
+	// Default is connect_failure and reset.
+	On []string `yaml:"on,omitempty"`
+	// Maximum duration of each attempt, in seconds. If not set, only the timeouts of the location apply.
+	PerTryTimeout int `yaml:"per_try_timeout,omitempty"`
+	// Delay before the first retry, in milliseconds. The delay doubles after each retry.
+	Backoff int `yaml:"backoff,omitempty"`
+	// Methods that can be retried. Default is idempotent methods only (GET, HEAD, OPTIONS, PUT, DELETE, TRACE).
+	Methods []string `yaml:"methods,omitempty"`
+}
+
+// MaxAttempts returns how many times a request with the given method can be sent upstream.
+func (retry *RetryConfig) MaxAttempts(method string) int {
+	if retry == nil || retry.Attempts <= 1 {
+		return 1
+	}
+	methods := retry.Methods
+	if len(methods) == 0 {
+		methods = IdempotentMethods
+	}
+	if !slices.ContainsFunc(methods, func(m string) bool { return strings.EqualFold(m, method) }) {
+		return 1
+	}
+	return retry.Attempts
+}
+
+// ShouldRetry reports whether the given failure kind or status code is a retry condition.
+func (retry *RetryConfig) ShouldRetry(condition string) bool {
+	if retry == nil {
+		return false
+	}
+	conditions := retry.On
+	if len(conditions) == 0 {
+		conditions = []string{RetryOnConnectFailure, RetryOnReset}
+	}
+	return slices.Contains(conditions, condition)
+}
+
+// ShouldRetryStatus reports whether an upstream response with this status code should be retried.
+func (retry *RetryConfig) ShouldRetryStatus(status int) bool {
+	return retry.ShouldRetry(strconv.Itoa(status))
+}
+
+// BackoffDelay returns the delay to wait before the given retry (1 for the first retry).
+func (retry *RetryConfig) BackoffDelay(retryNumber int) time.Duration {
+	if retry == nil || retry.Backoff <= 0 || retryNumber < 1 {
+		return 0
+	}
+	return time.Duration(retry.Backoff) * time.Millisecond * time.Duration(1<<(retryNumber-1))
+}
+
+// TryTimeout returns the maximum duration of a single attempt, or 0 if there is none.
+func (retry *RetryConfig) TryTimeout() time.Duration {
+	if retry == nil || retry.PerTryTimeout <= 0 {
+		return 0
+	}
+	return time.Duration(retry.PerTryTimeout) * time.Second
+}
+
+// ProxyFailureKind classifies an error returned while talking to an upstream.
+// connected tells whether the connection to the upstream had been established when the error occurred.
+func ProxyFailureKind(err error, connected bool) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RetryOnTimeout
+	}
+	if !connected {
+		return RetryOnConnectFailure
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryOnReset
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// ProxyTimeouts configures the timeouts of requests sent to the upstreams of a location, in seconds.
+// Timeouts that are not set default to the gateway timeout (90 seconds). Upstream timeouts are answered with 504.
+type ProxyTimeouts struct {
+	// Time allowed to connect to the upstream, including the TLS handshake.
+	Connect int `yaml:"connect,omitempty"`
+	// Time allowed to send the request to the upstream.
+	Send int `yaml:"send,omitempty"`
+	// Time allowed between the end of the request and the first byte of the response.
+	FirstByte int `yaml:"first_byte,omitempty"`
+	// Maximum time between two reads of the response, once the upstream has started to answer.
+	IdleRead int `yaml:"idle_read,omitempty"`
+	// Maximum time between two reads of a streamed response, such as Server-Sent Events. Default is 5 minutes.
+	// Streamed responses have no overall time limit.
+	StreamIdle int `yaml:"stream_idle,omitempty"`
+}
+
+// DefaultStreamIdleTimeout is the default maximum time between two reads of a streamed response.
+const DefaultStreamIdleTimeout = 5 * time.Minute
+
+func timeoutOrDefault(seconds int) time.Duration {
+	if seconds <= 0 {
+		return GatewayTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (timeouts *ProxyTimeouts) ConnectTimeout() time.Duration {
+	if timeouts == nil {
+		return GatewayTimeout
+	}
+	return timeoutOrDefault(timeouts.Connect)
+}
+
+func (timeouts *ProxyTimeouts) SendTimeout() time.Duration {
+	if timeouts == nil {
+		return GatewayTimeout
+	}
+	return timeoutOrDefault(timeouts.Send)
+}
+
+func (timeouts *ProxyTimeouts) FirstByteTimeout() time.Duration {
+	if timeouts == nil {
+		return GatewayTimeout
+	}
+	return timeoutOrDefault(timeouts.FirstByte)
+}
+
+func (timeouts *ProxyTimeouts) IdleReadTimeout() time.Duration {
+	if timeouts == nil {
+		return GatewayTimeout
+	}
+	return timeoutOrDefault(timeouts.IdleRead)
+}
+
+func (timeouts *ProxyTimeouts) StreamIdleTimeout() time.Duration {
+	if timeouts == nil || timeouts.StreamIdle <= 0 {
+		return DefaultStreamIdleTimeout
+	}
+	return time.Duration(timeouts.StreamIdle) * time.Second
+}
+
+// UpstreamConn applies the proxy timeouts to a connection to an upstream. Reads use the first-byte timeout until
+// data is received, then the idle timeout. No deadline ever goes past Deadline, if it is set.
+type UpstreamConn struct {
+	net.Conn
+	SendTimeout      time.Duration
+	FirstByteTimeout time.Duration
+	IdleTimeout      time.Duration
+	Deadline         time.Time
+
+	received bool
+}
+
+func (conn *UpstreamConn) deadline(timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if !conn.Deadline.IsZero() && conn.Deadline.Before(deadline) {
+		return conn.Deadline
+	}
+	return deadline
+}
+
+func (conn *UpstreamConn) Read(b []byte) (int, error) {
+	timeout := conn.IdleTimeout
+	if !conn.received {
+		timeout = conn.FirstByteTimeout
+	}
+	_ = conn.Conn.SetReadDeadline(conn.deadline(timeout))
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.received = true
+	}
+	return n, err
+}
+
+func (conn *UpstreamConn) Write(b []byte) (int, error) {
+	_ = conn.Conn.SetWriteDeadline(conn.deadline(conn.SendTimeout))
+	return conn.Conn.Write(b)
+}
+
+// ClientTimeout returns the time allowed to clients to send a request ("server.client_timeout", in seconds).
+func ClientTimeout() time.Duration {
+	seconds, ok := GetConfigValue("server.client_timeout", 60).(int)
+	if !ok || seconds <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request body buffering modes of a location ("request_buffering").
+const (
+	// Read the whole body before contacting upstreams, so that slow clients don't keep upstream connections busy.
+	RequestBufferingBuffer = "buffer"
+	// Send the body to upstreams as it is received from the client.
+	RequestBufferingStream = "stream"
+)
+
+// DefaultBodyBufferSize is the size above which buffered request bodies are written to a temporary file.
+const DefaultBodyBufferSize = 1 << 20
+
+// ErrBodyTooLarge is returned when a request body is larger than the maximum size of its location.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+var errBodyConsumed = errors.New("request body was already sent and cannot be sent again")
+
+// clientBodyError is an error receiving a streamed body from the client, as opposed to an error sending it upstream.
+type clientBodyError struct {
+	err error
+}
+
+func (e *clientBodyError) Error() string {
+	return "reading request body: " + e.err.Error()
+}
+
+func (e *clientBodyError) Unwrap() error {
+	return e.err
+}
+
+// ParseByteSize parses a size in bytes, with an optional unit: "512", "64K", "10M" or "1G". Units are powers of 1024.
+func ParseByteSize(value string) (int64, error) {
+	size := strings.ToUpper(strings.TrimSpace(value))
+	size = strings.TrimSuffix(size, "B")
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(size, unit) {
+			multiplier = 1 << (10 * (i + 1))
+			size = strings.TrimSuffix(size, unit)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return n * multiplier, nil
+}
+
+// RequestBody is a request body that is not held in memory: either a large buffered body written to a temporary file,
+// or a body streamed from the client as upstreams read it.
+type RequestBody struct {
+	mu       sync.Mutex
+	file     *os.File
+	stream   io.Reader
+	consumed bool
+	length   int64
+	refs     int
+}
+
+// Length returns the size of the body, or -1 if it is streamed and its size is unknown (chunked encoding).
+func (body *RequestBody) Length() int64 {
+	return body.length
+}
+
+// IsStreamed reports whether the body is received from the client as it is read.
+func (body *RequestBody) IsStreamed() bool {
+	return body.file == nil
+}
+
+// Replayable reports whether Reader can still be called, e.g. to retry the request on another upstream.
+func (body *RequestBody) Replayable() bool {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	return body.file != nil || !body.consumed
+}
+
+// Reader returns a reader of the whole body. Buffered bodies can be read several times, even concurrently, while
+// streamed bodies can only be read once.
+func (body *RequestBody) Reader() (io.Reader, error) {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	if body.file != nil {
+		return io.NewSectionReader(body.file, 0, body.length), nil
+	}
+	if body.consumed {
+		return nil, errBodyConsumed
+	}
+	body.consumed = true
+	return body.stream, nil
+}
+
+// Retain keeps the body available until a matching call to Close, e.g. for a mirrored request that may outlive the
+// client request.
+func (body *RequestBody) Retain() {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	body.refs++
+}
+
+// Close releases the body. The temporary file is deleted once every user of the body closed it.
+func (body *RequestBody) Close() error {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	body.refs--
+	if body.refs > 0 || body.file == nil {
+		return nil
+	}
+	err := body.file.Close()
+	_ = os.Remove(body.file.Name())
+	return err
+}
+
+// maxBodyReader fails with ErrBodyTooLarge when more than the remaining bytes are read.
+type maxBodyReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *maxBodyReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n - 1, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// clientBodyReader wraps the errors of a streamed body in clientBodyError.
+type clientBodyReader struct {
+	reader io.Reader
+}
+
+func (r *clientBodyReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &clientBodyError{err: err}
+	}
+	return n, err
+}
+
+// idleDeadlineReader extends the read deadline of the connection before every read, so that a streamed body can take
+// any time to be received, as long as the client keeps sending data.
+type idleDeadlineReader struct {
+	reader  io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleDeadlineReader) Read(p []byte) (int, error) {
+	_ = r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.reader.Read(p)
+}
+
+// ReadRequestBody reads the body of a request whose head was read by ReadRequestHead, according to the settings of
+// the location it matches. A nil location doesn't limit the body. When the body is rejected, the status to respond
+// with is returned: 413 if it is too large, 408 if the client is too slow, or 400 if it is malformed.
+func ReadRequestBody(conn net.Conn, request *HttpRequest, location *HostLocation) (int, error) {
+	var limit, bufferSize int64 = 0, DefaultBodyBufferSize
+	streaming := false
+	if location != nil {
+		limit = location.maxBodySize
+		if location.bodyBufferSize > 0 {
+			bufferSize = location.bodyBufferSize
+		}
+		// Other locations need the whole body, e.g. to send its length to FastCGI servers
+		streaming = location.RequestBuffering == RequestBufferingStream && location.IsProxy()
+	}
+
+	if request.body == nil {
+		// HTTP/2 requests are read up to their HEADERS frame, so their DATA frames are never buffered. The declared
+		// length and the part of the body already in Body are checked.
+		length, err := strconv.ParseInt(request.Headers["content-length"], 10, 64)
+		if limit > 0 && (err == nil && length > limit || int64(len(request.Body)) > limit) {
+			return 413, ErrBodyTooLarge
+		}
+		return 0, nil
+	}
+	// Rejected before reading anything when the length is known
+	if limit > 0 && request.bodyLength > limit {
+		return 413, ErrBodyTooLarge
+	}
+	// Clients waiting for approval before sending the body get it once the body is known to be acceptable
+	if strings.EqualFold(request.Headers["expect"], "100-continue") {
+		delete(request.Headers, "expect")
+		if _, err := conn.Write([]byte("HTTP/1.1 100 Continue" + CRLF + CRLF)); err != nil {
+			return 400, err
+		}
+	}
+	body := request.body
+	request.body = nil
+	if limit > 0 {
+		body = &maxBodyReader{reader: body, remaining: limit}
+	}
+
+	if streaming {
+		_ = conn.SetReadDeadline(time.Time{})
+		request.BodySource = &RequestBody{
+			stream: &clientBodyReader{reader: &idleDeadlineReader{reader: body, conn: conn, timeout: ClientTimeout()}},
+			length: request.bodyLength,
+			refs:   1,
+		}
+		return 0, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, bufferSize+1))
+	if err != nil {
+		return bodyErrorStatus(err), err
+	}
+	if int64(len(data)) <= bufferSize {
+		request.Body = string(data)
+		return 0, nil
+	}
+
+	// Too large to be kept in memory
+	file, err := os.CreateTemp("", "iridium-body-*")
+	if err != nil {
+		return 500, err
+	}
+	requestBody := &RequestBody{file: file, refs: 1}
+	_, err = file.Write(data)
+	if err == nil {
+		requestBody.length, err = io.Copy(file, body)
+		requestBody.length += int64(len(data))
+	}
+	if err != nil {
+		_ = requestBody.Close()
+		return bodyErrorStatus(err), err
+	}
+	request.BodySource = requestBody
+	return 0, nil
+}
+
+func bodyErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, ErrBodyTooLarge) {
+		return 413
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		return 408
+	}
+	return 400
+}
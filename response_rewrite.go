@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+// UpstreamRewriteConfig configures how the upstream address is replaced in the Location, Content-Location, Refresh and
+// Set-Cookie headers of proxied responses. Replacement values can contain variables, e.g. "https://$host/".
+type UpstreamRewriteConfig struct {
+	// Disable the automatic mapping of the upstream address and base path to the host and path prefix used by the
+	// client. Default is false.
+	DisableAuto bool `yaml:"disable_auto,omitempty"`
+	// URL prefixes to replace in the Location, Content-Location and Refresh headers,
+	// e.g. {"http://10.0.0.5:8080/": "https://$host/"}. The longest matching prefix is used.
+	Redirects map[string]string `yaml:"redirects,omitempty"`
+	// Cookie domains to replace, e.g. {"internal.local": "$host"}. "*" matches every domain.
+	// An empty replacement removes the Domain attribute.
+	CookieDomains map[string]string `yaml:"cookie_domains,omitempty"`
+	// Cookie path prefixes to replace, e.g. {"/app/": "/"}. The longest matching prefix is used.
+	CookiePaths map[string]string `yaml:"cookie_paths,omitempty"`
+}
+
+// upstreamRewriter rewrites the headers of a response received from a single upstream.
+type upstreamRewriter struct {
+	config    *UpstreamRewriteConfig
+	variables map[string]string
+	// Origins of the upstream, e.g. "http://10.0.0.5:8080", and the origin used by the client
+	upstreamOrigins []string
+	publicOrigin    string
+	// Domain of the upstream and the one used by the client, without port
+	upstreamDomain string
+	publicDomain   string
+	// Path prefix of the upstream, and the one used by the client
+	upstreamBase string
+	publicBase   string
+}
+
+// RewriteUpstreamResponse replaces the address of the upstream in the Location, Content-Location, Refresh and
+// Set-Cookie headers of the response with the host and path prefix used by the client.
+func (location HostLocation) RewriteUpstreamResponse(headers map[string]string, upstream string, request HttpRequest) {
+	target, err := ParseUpstream(upstream)
+	if err != nil {
+		return
+	}
+	publicHost := request.Headers["host"]
+	rewriter := upstreamRewriter{
+		config:       location.UpstreamRewrite,
+		variables:    RequestVariables(request, location),
+		publicOrigin: request.Scheme + "://" + publicHost,
+		publicDomain: publicHost,
+	}
+	if hostname, _, err := net.SplitHostPort(publicHost); err == nil {
+		rewriter.publicDomain = hostname
+	}
+	if !location.PreserveHost {
+		hosts := []string{target.HostHeader(), location.UpstreamHost}
+		if target.Scheme != "unix" {
+			hosts = append(hosts, target.Address)
+		}
+		for _, host := range hosts {
+			if host != "" {
+				rewriter.upstreamOrigins = append(rewriter.upstreamOrigins, "http://"+host, "https://"+host)
+			}
+		}
+		rewriter.upstreamDomain = target.Hostname
+	}
+	rewriter.upstreamBase = target.BasePath
+	if location.Rewrite != nil {
+		// Expanded with the same captures as the request path
+		addPrefix := ExpandVariables(location.Rewrite.AddPrefix, request.LocationCaptures)
+		rewriter.upstreamBase = JoinURLPath(target.BasePath, addPrefix)
+		rewriter.publicBase = ExpandVariables(location.Rewrite.StripPrefix, request.LocationCaptures)
+	}
+
+	for _, name := range []string{"location", "content-location"} {
+		if value, ok := headers[name]; ok {
+			headers[name] = rewriter.rewriteURL(value)
+		}
+	}
+	if refresh, ok := headers["refresh"]; ok {
+		headers["refresh"] = rewriter.rewriteRefresh(refresh)
+	}
+	if cookies, ok := headers["set-cookie"]; ok {
+		lines := strings.Split(cookies, "\n")
+		for i, cookie := range lines {
+			lines[i] = rewriter.rewriteCookie(cookie)
+		}
+		headers["set-cookie"] = strings.Join(lines, "\n")
+	}
+}
+
+func (rewriter upstreamRewriter) auto() bool {
+	return rewriter.config == nil || !rewriter.config.DisableAuto
+}
+
+// replacePrefix replaces the longest key of the replacements that prefixes s. The keys are compared case-insensitively
+// if foldCase is set.
+func (rewriter upstreamRewriter) replacePrefix(s string, replacements map[string]string, foldCase bool) (string, bool) {
+	prefixes := make([]string, 0, len(replacements))
+	for prefix := range replacements {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.SortFunc(prefixes, func(a, b string) int { return len(b) - len(a) })
+	for _, prefix := range prefixes {
+		matches := strings.HasPrefix(s, prefix)
+		if foldCase {
+			matches = len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+		}
+		if matches {
+			return ExpandVariables(replacements[prefix], rewriter.variables) + s[len(prefix):], true
+		}
+	}
+	return s, false
+}
+
+// rewritePath maps a path under the base path of the upstream to the path prefix used by the client.
+func (rewriter upstreamRewriter) rewritePath(path string) string {
+	if rewriter.upstreamBase == rewriter.publicBase {
+		return path
+	}
+	base := strings.TrimSuffix(rewriter.upstreamBase, "/")
+	if base != "" && path != base && !strings.HasPrefix(path, base+"/") && !strings.HasPrefix(path, base+"?") {
+		return path
+	}
+	return JoinURLPath(rewriter.publicBase, "/"+strings.TrimPrefix(path[len(base):], "/"))
+}
+
+func (rewriter upstreamRewriter) rewriteURL(value string) string {
+	if rewriter.config != nil {
+		if rewritten, ok := rewriter.replacePrefix(value, rewriter.config.Redirects, true); ok {
+			return rewritten
+		}
+	}
+	if !rewriter.auto() {
+		return value
+	}
+
+	for _, origin := range rewriter.upstreamOrigins {
+		if len(value) < len(origin) || !strings.EqualFold(value[:len(origin)], origin) {
+			continue
+		}
+		rest := value[len(origin):]
+		if rest == "" {
+			return rewriter.publicOrigin + rewriter.rewritePath("/")
+		}
+		if rest[0] == '/' {
+			return rewriter.publicOrigin + rewriter.rewritePath(rest)
+		}
+		if rest[0] == '?' {
+			return rewriter.publicOrigin + rewriter.rewritePath("/") + rest
+		}
+	}
+	if strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//") {
+		return rewriter.rewritePath(value)
+	}
+	return value
+}
+
+// rewriteRefresh rewrites the URL of a Refresh header, e.g. "5; url=http://10.0.0.5:8080/".
+func (rewriter upstreamRewriter) rewriteRefresh(value string) string {
+	i := strings.Index(strings.ToLower(value), "url=")
+	if i == -1 {
+		return value
+	}
+	url := strings.Trim(value[i+4:], `"' `)
+	return value[:i+4] + rewriter.rewriteURL(url)
+}
+
+func (rewriter upstreamRewriter) rewriteCookie(cookie string) string {
+	attributes := strings.Split(cookie, ";")
+	kept := attributes[:1]
+	for _, attribute := range attributes[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(attribute), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			domain, ok := rewriter.rewriteCookieDomain(value)
+			if !ok {
+				continue
+			}
+			attribute = " " + name + "=" + domain
+		case "path":
+			attribute = " " + name + "=" + rewriter.rewriteCookiePath(value)
+		}
+		kept = append(kept, attribute)
+	}
+	return strings.Join(kept, ";")
+}
+
+// rewriteCookieDomain returns the domain to use instead of the given one, or false if the Domain attribute must be
+// removed.
+func (rewriter upstreamRewriter) rewriteCookieDomain(domain string) (string, bool) {
+	bare := strings.TrimPrefix(domain, ".")
+	if rewriter.config != nil && len(rewriter.config.CookieDomains) > 0 {
+		for from, to := range rewriter.config.CookieDomains {
+			if strings.EqualFold(strings.TrimPrefix(from, "."), bare) {
+				return rewriter.cookieDomainValue(to)
+			}
+		}
+		if to, ok := rewriter.config.CookieDomains["*"]; ok {
+			return rewriter.cookieDomainValue(to)
+		}
+	}
+	if rewriter.auto() && rewriter.upstreamDomain != "" && strings.EqualFold(bare, rewriter.upstreamDomain) {
+		return rewriter.publicDomain, true
+	}
+	return domain, true
+}
+
+func (rewriter upstreamRewriter) cookieDomainValue(value string) (string, bool) {
+	value = ExpandVariables(value, rewriter.variables)
+	if hostname, _, err := net.SplitHostPort(value); err == nil {
+		value = hostname
+	}
+	return value, value != ""
+}
+
+func (rewriter upstreamRewriter) rewriteCookiePath(path string) string {
+	if rewriter.config != nil {
+		if rewritten, ok := rewriter.replacePrefix(path, rewriter.config.CookiePaths, false); ok {
+			return rewritten
+		}
+	}
+	if !rewriter.auto() {
+		return path
+	}
+	return rewriter.rewritePath(path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestRewriteUpstreamResponseWithLocationCaptures(t *testing.T) {
+	host := Host{
+		Domain: "example.com",
+		Locations: []HostLocation{{
+			Match:   "~ ^/(?P<version>v[0-9]+)/",
+			Proxy:   StrPtr("http://10.0.0.5:8080"),
+			Rewrite: &RewriteConfig{StripPrefix: "/$version"},
+		}},
+	}
+	location := &host.Locations[0]
+	if err := location.compileMatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := location.Rewrite.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	matched, captures := host.FindLocation("/v2/users?page=1")
+	if matched != location || captures["version"] != "v2" {
+		t.Fatalf("FindLocation() = %v, %v, want the regex location with version v2", matched, captures)
+	}
+	request := HttpRequest{
+		Path:             "/v2/users?page=1",
+		Scheme:           "https",
+		Headers:          map[string]string{"host": "example.com"},
+		LocationCaptures: captures,
+	}
+	if path := location.Rewrite.Apply(request.Path, captures); path != "/users?page=1" {
+		t.Fatalf("Apply() = %q, want %q", path, "/users?page=1")
+	}
+
+	headers := map[string]string{
+		"location":   "http://10.0.0.5:8080/login?next=/users",
+		"refresh":    "0; url=/account",
+		"set-cookie": "session=abc; Path=/; HttpOnly",
+	}
+	matched.RewriteUpstreamResponse(headers, "http://10.0.0.5:8080", request)
+	want := map[string]string{
+		"location":   "https://example.com/v2/login?next=/users",
+		"refresh":    "0; url=/v2/account",
+		"set-cookie": "session=abc; Path=/v2/; HttpOnly",
+	}
+	for name, value := range want {
+		if headers[name] != value {
+			t.Errorf("%s = %q, want %q", name, headers[name], value)
+		}
+	}
+}
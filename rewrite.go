@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteConfig describes how the request path is rewritten for a location. The steps are applied in this order:
+// strip_prefix, rules, add_prefix. The query string is left untouched. Named captures of the location regex can be used
+// in the prefixes and replacements, e.g. "/$version".
+type RewriteConfig struct {
+	// Prefix to remove from the path, e.g. "/api" turns "/api/users" into "/users".
+	StripPrefix string `yaml:"strip_prefix,omitempty"`
+	// Prefix to add to the path, e.g. "/v2" turns "/users" into "/v2/users".
+	AddPrefix string `yaml:"add_prefix,omitempty"`
+	// Regex replacements. Capture groups can be used in the replacement as $1 or ${name}.
+	Rules []RewriteRule `yaml:"rules,omitempty"`
+}
+
+type RewriteRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+
+	regex *regexp.Regexp
+}
+
+// Compile compiles the regex rules. It must be called before Apply.
+func (rewrite *RewriteConfig) Compile() error {
+	if rewrite == nil {
+		return nil
+	}
+	for i := range rewrite.Rules {
+		regex, err := regexp.Compile(rewrite.Rules[i].Match)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite rule %q: %v", rewrite.Rules[i].Match, err)
+		}
+		rewrite.Rules[i].regex = regex
+	}
+	return nil
+}
+
+// Apply returns the rewritten path, using the named captures of the location regex. A nil configuration returns the
+// path unchanged.
+func (rewrite *RewriteConfig) Apply(path string, captures map[string]string) string {
+	if rewrite == nil {
+		return path
+	}
+	path, query, hasQuery := strings.Cut(path, "?")
+
+	path = StripPathPrefix(path, ExpandVariables(rewrite.StripPrefix, captures))
+	for _, rule := range rewrite.Rules {
+		if rule.regex != nil {
+			path = rule.regex.ReplaceAllString(path, rule.replacement(captures))
+		}
+	}
+	if addPrefix := ExpandVariables(rewrite.AddPrefix, captures); addPrefix != "" {
+		path = JoinURLPath(addPrefix, path)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	if hasQuery {
+		return path + "?" + query
+	}
+	return path
+}
+
+// replacement returns the replacement template of the rule, with the named captures of the location regex inserted
+// as literal text. Capture groups of the rule take precedence over location captures with the same name. The template
+// is scanned once, so that captured values are never expanded.
+func (rule RewriteRule) replacement(captures map[string]string) string {
+	if len(captures) == 0 {
+		return rule.Replace
+	}
+	var template strings.Builder
+	s := rule.Replace
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			break
+		}
+		template.WriteString(s[:i])
+		name, reference := templateReference(s[i:])
+		if value, ok := captures[name]; ok && rule.regex.SubexpIndex(name) < 0 {
+			template.WriteString(strings.ReplaceAll(value, "$", "$$"))
+		} else {
+			template.WriteString(reference)
+		}
+		s = s[i+len(reference):]
+	}
+	template.WriteString(s)
+	return template.String()
+}
+
+// templateReference returns the reference at the start of a regex replacement template starting with "$", such as
+// "$name", "${name}" or "$$", and the name it refers to, if any.
+func templateReference(s string) (string, string) {
+	if strings.HasPrefix(s, "$$") {
+		return "", "$$"
+	}
+	if strings.HasPrefix(s, "${") {
+		if end := strings.IndexByte(s, '}'); end != -1 {
+			return s[2:end], s[:end+1]
+		}
+		return "", "$"
+	}
+	end := 1
+	for end < len(s) && isTemplateNameByte(s[end]) {
+		end++
+	}
+	return s[1:end], s[:end]
+}
+
+func isTemplateNameByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// StripPathPrefix removes a prefix made of whole path segments from the path, e.g. "/api" or "/api/" turns "/api/users"
+// into "/users" but leaves "/apiary" unchanged.
+func StripPathPrefix(path, prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return path
+	}
+	if path == prefix || strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix):]
+	}
+	return path
+}
+
+// JoinURLPath joins two URL paths with a single slash between them.
+func JoinURLPath(base, path string) string {
+	if base == "" || base == "/" {
+		return path
+	}
+	if path == "" || path == "/" {
+		if strings.HasSuffix(base, "/") {
+			return base
+		}
+		return base + path
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
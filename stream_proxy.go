@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StartTCPStream listens for TCP connections and forwards them to the upstreams of the stream.
+func StartTCPStream(stream *Stream) error {
+	listener, err := net.Listen("tcp", stream.Listen)
+	if err != nil {
+		return err
+	}
+	listener = WrapProxyProtocolListener(listener)
+	if stream.tlsConfig != nil {
+		listener = tls.NewListener(listener, stream.tlsConfig)
+	}
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				ErrorLog(fmt.Errorf("stream %s: %w", stream.name, err))
+				continue
+			}
+			go handleTCPStream(stream, conn)
+		}
+	}()
+	return nil
+}
+
+func handleTCPStream(stream *Stream, conn net.Conn) {
+	defer conn.Close()
+	// Reading the address may require receiving a PROXY protocol header
+	_ = conn.SetReadDeadline(time.Now().Add(ClientTimeout()))
+	clientAddr := conn.RemoteAddr()
+	clientIP := GetLocalIpWithoutPort(clientAddr.String())
+	if !stream.IsClientAllowed(clientIP) {
+		AppendLog("INFO", fmt.Sprintf("Stream %s: connection from %s denied", stream.name, clientIP))
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			ErrorLog(fmt.Errorf("stream %s: %w", stream.name, err))
+			return
+		}
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	ForwardTCPStream(stream, conn)
+}
+
+// ForwardTCPStream connects to an upstream of the stream and copies data in both directions until either side closes
+// its connection or the connection is idle. The client connection is not closed.
+func ForwardTCPStream(stream *Stream, conn net.Conn) {
+	clientAddr := conn.RemoteAddr()
+	upstream, upstreamConn, err := dialStreamUpstream(stream, clientAddr, conn.LocalAddr())
+	if err != nil {
+		ErrorLog(fmt.Errorf("stream %s: %w", stream.name, err))
+		return
+	}
+	defer upstreamConn.Close()
+	AppendLog("INFO", fmt.Sprintf("Stream %s: %s connected to %s", stream.name, GetLocalIpWithoutPort(clientAddr.String()), upstream))
+
+	var activity atomic.Int64
+	activity.Store(time.Now().UnixNano())
+	done := make(chan error, 2)
+	go func() { done <- pipeStream(upstreamConn, conn, stream.idleTimeout(), &activity) }()
+	go func() { done <- pipeStream(conn, upstreamConn, stream.idleTimeout(), &activity) }()
+	// The connection is closed when either side is done. Half-closed connections are not kept open.
+	<-done
+}
+
+// dialStreamUpstream connects to an upstream of the stream, trying every upstream until one accepts the connection.
+func dialStreamUpstream(stream *Stream, clientAddr, localAddr net.Addr) (string, net.Conn, error) {
+	var tried []string
+	var lastErr error
+	for range stream.pool.Members() {
+		upstream, ok := stream.pool.Pick(tried)
+		if !ok {
+			break
+		}
+		tried = append(tried, upstream)
+
+		network, address := "tcp", upstream
+		if socketPath, found := strings.CutPrefix(upstream, "unix:"); found {
+			network, address = "unix", socketPath
+		}
+		conn, err := net.DialTimeout(network, address, stream.connectTimeout())
+		if err != nil {
+			MarkUpstreamFailed(upstream)
+			lastErr = err
+			continue
+		}
+		if stream.proxyProtocolVersion != 0 {
+			header := EncodeProxyProtocolHeader(stream.proxyProtocolVersion, clientAddr, localAddr)
+			if _, err := conn.Write(header); err != nil {
+				conn.Close()
+				lastErr = err
+				continue
+			}
+		}
+		return upstream, conn, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream available")
+	}
+	return "", nil, lastErr
+}
+
+// pipeStream copies data from src to dst until src is closed, or until neither direction has seen traffic for the
+// idle timeout. activity is shared by both directions of a connection.
+func pipeStream(dst, src net.Conn, idleTimeout time.Duration, activity *atomic.Int64) error {
+	buf := make([]byte, 32*1024)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			activity.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, activity.Load())) < idleTimeout {
+				// The other direction is still active
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// udpSession is the association between a client and an upstream of a UDP stream.
+type udpSession struct {
+	upstream string
+	conn     net.Conn
+	header   []byte
+	activity atomic.Int64
+}
+
+// StartUDPStream listens for UDP datagrams and forwards them to the upstreams of the stream. Each client address gets
+// its own session, pinned to one upstream, whose replies are sent back to the client.
+func StartUDPStream(stream *Stream) error {
+	listener, err := net.ListenPacket("udp", stream.Listen)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	go func() {
+		defer listener.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			n, clientAddr, err := listener.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				ErrorLog(fmt.Errorf("stream %s: %w", stream.name, err))
+				continue
+			}
+			if !stream.IsClientAllowed(GetLocalIpWithoutPort(clientAddr.String())) {
+				continue
+			}
+
+			mu.Lock()
+			session, ok := sessions[clientAddr.String()]
+			if !ok {
+				session, err = newUDPSession(stream, listener, clientAddr, func(closed *udpSession) {
+					mu.Lock()
+					if sessions[clientAddr.String()] == closed {
+						delete(sessions, clientAddr.String())
+					}
+					mu.Unlock()
+				})
+				if err != nil {
+					mu.Unlock()
+					ErrorLog(fmt.Errorf("stream %s: %w", stream.name, err))
+					continue
+				}
+				sessions[clientAddr.String()] = session
+			}
+			mu.Unlock()
+
+			session.activity.Store(time.Now().UnixNano())
+			datagram := append(append([]byte(nil), session.header...), buf[:n]...)
+			if _, err := session.conn.Write(datagram); err != nil {
+				ErrorLog(fmt.Errorf("stream %s: %w", stream.name, err))
+			}
+		}
+	}()
+	return nil
+}
+
+// newUDPSession connects to an upstream for the client and starts relaying its replies. closed is called when the
+// session ends, after the idle timeout or an upstream error.
+func newUDPSession(stream *Stream, listener net.PacketConn, clientAddr net.Addr, closed func(*udpSession)) (*udpSession, error) {
+	upstream, ok := stream.pool.Pick(nil)
+	if !ok {
+		return nil, errors.New("no upstream available")
+	}
+	conn, err := net.DialTimeout("udp", upstream, stream.connectTimeout())
+	if err != nil {
+		MarkUpstreamFailed(upstream)
+		return nil, err
+	}
+	session := &udpSession{upstream: upstream, conn: conn}
+	session.activity.Store(time.Now().UnixNano())
+	if stream.proxyProtocolVersion != 0 {
+		session.header = EncodeProxyProtocolHeader(stream.proxyProtocolVersion, clientAddr, listener.LocalAddr())
+	}
+
+	go func() {
+		defer closed(session)
+		defer conn.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(stream.idleTimeout()))
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				isTimeout := errors.As(err, &netErr) && netErr.Timeout()
+				if isTimeout && time.Since(time.Unix(0, session.activity.Load())) < stream.idleTimeout() {
+					// The client is still sending datagrams
+					continue
+				}
+				if !isTimeout {
+					// e.g. "connection refused", reported by ICMP
+					MarkUpstreamFailed(upstream)
+					ErrorLog(fmt.Errorf("stream %s: %s: %w", stream.name, upstream, err))
+				}
+				return
+			}
+			session.activity.Store(time.Now().UnixNano())
+			if _, err := listener.WriteTo(buf[:n], clientAddr); err != nil {
+				return
+			}
+		}
+	}()
+	return session, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"iridium/http2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// IsStreamingResponse reports whether the body of an upstream response must be sent to the client as it is received,
+// instead of being read entirely first: for Server-Sent Events, chunked responses, or every response of a location
+// with streaming enabled.
+func IsStreamingResponse(headers map[string]string, location HostLocation) bool {
+	if location.Streaming {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(headers["content-type"], ";")
+	if strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+		return true
+	}
+	_, hasLength := headers["content-length"]
+	return strings.EqualFold(headers["transfer-encoding"], "chunked") && !hasLength
+}
+
+// streamBody is the body of a streamed upstream response. Closing it closes the connection to the upstream.
+type streamBody struct {
+	io.Reader
+	conn    net.Conn
+	closers []io.Closer
+}
+
+func (body *streamBody) Close() error {
+	for _, closer := range body.closers {
+		_ = closer.Close()
+	}
+	return body.conn.Close()
+}
+
+// serveStream sends a response whose body is read from resp.Stream, writing each part to the client as soon as it is
+// received. The body is never compressed again. HTTP/1.1 responses use chunked transfer encoding.
+func serveStream(conn net.Conn, request HttpRequest, resp ResponseServed) {
+	defer resp.Stream.Close()
+	if resp.ContentType == nil {
+		defaultType := "text/html; charset=utf-8"
+		resp.ContentType = &defaultType
+	}
+
+	headers := [][2]string{
+		{"server", fmt.Sprintf("Iridium/%s", VERSION)},
+		{"content-type", *resp.ContentType},
+		{"date", time.Now().UTC().Format(http.TimeFormat)},
+	}
+	if resp.ContentEncoding != "" {
+		headers = append(headers, [2]string{"content-encoding", resp.ContentEncoding})
+	}
+	for k, v := range resp.Headers {
+		k = strings.TrimSpace(strings.ToLower(k))
+		if slices.Contains(ServerIgnoredHeaders, k) {
+			continue
+		}
+		for _, line := range strings.Split(v, "\n") {
+			headers = append(headers, [2]string{k, line})
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	if request.Version == "HTTP/1.1" || request.Version == "HTTP/1.0" {
+		chunked := request.Version == "HTTP/1.1"
+		var head strings.Builder
+		head.WriteString(fmt.Sprintf("HTTP/1.1 %d\r\n", resp.Status))
+		if chunked {
+			head.WriteString("transfer-encoding: chunked\r\n")
+		}
+		head.WriteString("connection: close\r\n")
+		for _, header := range headers {
+			head.WriteString(header[0] + ": " + header[1] + CRLF)
+		}
+		head.WriteString(CRLF)
+		if _, err := conn.Write([]byte(head.String())); err != nil {
+			return
+		}
+
+		for {
+			n, err := resp.Stream.Read(buf)
+			if n > 0 {
+				data := buf[:n]
+				if chunked {
+					data = []byte(fmt.Sprintf("%x\r\n%s\r\n", n, data))
+				}
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					ErrorLog(fmt.Errorf("error reading streamed response: %w", err))
+					// The client sees an incomplete response, instead of a valid end of the body
+					return
+				}
+				break
+			}
+		}
+		if chunked {
+			_, _ = conn.Write([]byte("0\r\n\r\n"))
+		}
+		return
+	}
+
+	if request.Version != "HTTP/2.0" || request.StreamID == nil {
+		return
+	}
+	var headerBlock bytes.Buffer
+	encoder := hpack.NewEncoder(&headerBlock)
+	_ = encoder.WriteField(hpack.HeaderField{Name: ":status", Value: fmt.Sprintf("%d", resp.Status)})
+	for _, header := range headers {
+		_ = encoder.WriteField(hpack.HeaderField{Name: header[0], Value: header[1]})
+	}
+	if err := http2.WriteFrame(conn, http2.HeadersFrameType, http2.EndHeadersFlag, *request.StreamID, headerBlock.Bytes()); err != nil {
+		return
+	}
+	for {
+		n, err := resp.Stream.Read(buf)
+		for start := 0; start < n; start += http2.MaxFrameSize {
+			end := min(start+http2.MaxFrameSize, n)
+			if err := http2.WriteFrame(conn, http2.DataFrameType, 0, *request.StreamID, buf[start:end]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				ErrorLog(fmt.Errorf("error reading streamed response: %w", err))
+				_ = http2.WriteFrame(conn, http2.RSTStreamFrameType, 0, *request.StreamID, []byte{0, 0, 0, 2})
+				return
+			}
+			break
+		}
+	}
+	_ = http2.WriteFrame(conn, http2.DataFrameType, http2.EndStreamFlag, *request.StreamID, nil)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Stream is a layer 4 proxy, forwarding raw TCP connections or UDP datagrams to a group of upstreams.
+// Streams are loaded from the "streams" directory, next to the "hosts" directory, one stream per file.
+type Stream struct {
+	// Address to listen on, e.g. ":5432" or "0.0.0.0:27015".
+	Listen string `yaml:"listen"`
+	// Either "tcp" or "udp". Default is tcp.
+	Protocol string `yaml:"protocol,omitempty"`
+	// Addresses to forward the traffic to, e.g. "10.0.0.5:5432". Connections are load balanced across them.
+	// TCP streams also accept Unix domain sockets, e.g. "unix:/run/redis.sock".
+	Upstreams []string `yaml:"upstreams"`
+	// Terminate TLS on incoming connections before forwarding them (TCP only).
+	TLS *StreamTLSConfig `yaml:"tls,omitempty"`
+	// PROXY protocol header to send to upstreams, carrying the client address: "v1" or "v2". UDP streams only support
+	// "v2", and send the header at the start of every datagram. Default is none.
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty"`
+	// IP addresses or CIDR ranges allowed to connect. Default is everyone.
+	Allow []string `yaml:"allow,omitempty"`
+	// IP addresses or CIDR ranges that are denied, even if they are allowed.
+	Deny []string `yaml:"deny,omitempty"`
+	// Time allowed to connect to an upstream, in seconds. Default is 10 seconds.
+	ConnectTimeout int `yaml:"connect_timeout,omitempty"`
+	// Connections (or UDP sessions) without traffic in either direction for this long are closed, in seconds.
+	// Default is 10 minutes for TCP and 1 minute for UDP.
+	IdleTimeout int `yaml:"idle_timeout,omitempty"`
+	// Active checks of the upstreams (TCP only). By default, upstreams are only skipped for a while after a connection
+	// to them failed.
+	HealthCheck *HealthCheckConfig `yaml:"health_check,omitempty"`
+
+	name                 string
+	pool                 *UpstreamPool
+	allow                []*net.IPNet
+	deny                 []*net.IPNet
+	proxyProtocolVersion int
+	tlsConfig            *tls.Config
+}
+
+type StreamTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// PrepareStream validates a stream after it has been parsed and initializes its runtime state.
+func PrepareStream(stream *Stream) error {
+	stream.Protocol = strings.ToLower(stream.Protocol)
+	if stream.Protocol == "" {
+		stream.Protocol = "tcp"
+	}
+	if stream.Protocol != "tcp" && stream.Protocol != "udp" {
+		return fmt.Errorf("unsupported protocol: %s", stream.Protocol)
+	}
+	if stream.Listen == "" {
+		return errors.New("listen address is required")
+	}
+	if len(stream.Upstreams) == 0 {
+		return errors.New("at least one upstream is required")
+	}
+	for _, upstream := range stream.Upstreams {
+		if strings.HasPrefix(upstream, "unix:") && stream.Protocol == "tcp" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return fmt.Errorf("invalid upstream address %s: %v", upstream, err)
+		}
+	}
+
+	version, err := ParseProxyProtocolVersion(stream.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	if version == 1 && stream.Protocol == "udp" {
+		return errors.New("UDP streams only support PROXY protocol v2")
+	}
+	stream.proxyProtocolVersion = version
+	if stream.HealthCheck != nil && stream.Protocol != "tcp" {
+		return errors.New("health checks are only supported for TCP streams")
+	}
+
+	if stream.TLS != nil {
+		if stream.Protocol != "tcp" {
+			return errors.New("TLS termination is only supported for TCP streams")
+		}
+		cert, err := tls.LoadX509KeyPair(stream.TLS.CertFile, stream.TLS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		stream.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	allow, err := ParseCIDRList(stream.Allow)
+	if err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+	deny, err := ParseCIDRList(stream.Deny)
+	if err != nil {
+		return fmt.Errorf("deny: %v", err)
+	}
+	stream.allow, stream.deny = allow, deny
+	stream.pool = NewUpstreamPool(stream.Upstreams)
+	return nil
+}
+
+// IsClientAllowed applies the allow and deny lists of the stream to a client IP address.
+func (stream *Stream) IsClientAllowed(ip string) bool {
+	if IsIPInList(ip, stream.deny) {
+		return false
+	}
+	return len(stream.Allow) == 0 || IsIPInList(ip, stream.allow)
+}
+
+func (stream *Stream) connectTimeout() time.Duration {
+	if stream.ConnectTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(stream.ConnectTimeout) * time.Second
+}
+
+func (stream *Stream) idleTimeout() time.Duration {
+	if stream.IdleTimeout > 0 {
+		return time.Duration(stream.IdleTimeout) * time.Second
+	}
+	if stream.Protocol == "udp" {
+		return time.Minute
+	}
+	return 10 * time.Minute
+}
+
+// LoadStreams loads the stream configurations. Unlike hosts, the streams directory is optional.
+func LoadStreams() ([]*Stream, error) {
+	streamsDir := GetDataDirectory() + string(os.PathSeparator) + "streams"
+	files, err := os.ReadDir(streamsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read streams directory: %v", err)
+	}
+
+	println("Loading stream configurations from", streamsDir)
+	var streams []*Stream
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(file.Name(), ".yml") && !strings.HasSuffix(file.Name(), ".yaml") {
+			continue
+		}
+		path := streamsDir + string(os.PathSeparator) + file.Name()
+		println("Loading stream configuration from", path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			println("Failed to read stream file", path, ":", err.Error())
+			continue
+		}
+		var stream Stream
+		if err := yaml.Unmarshal(content, &stream); err != nil {
+			println("Failed to parse stream file", path, ":", err.Error())
+			continue
+		}
+		if err := PrepareStream(&stream); err != nil {
+			println("Invalid stream file", path, ":", err.Error())
+			continue
+		}
+		stream.name = strings.TrimSuffix(strings.TrimSuffix(file.Name(), ".yml"), ".yaml")
+		streams = append(streams, &stream)
+	}
+	return streams, nil
+}
+
+// StartStreams starts listening for every stream. Streams that can't listen are logged and skipped.
+func StartStreams(streams []*Stream) {
+	for _, stream := range streams {
+		var err error
+		if stream.Protocol == "udp" {
+			err = StartUDPStream(stream)
+		} else {
+			err = StartTCPStream(stream)
+		}
+		if err != nil {
+			ErrorLog(fmt.Errorf("stream %s: %w", stream.name, err))
+			continue
+		}
+		fmt.Printf("Stream %s is running on %s/%s\n", stream.name, stream.Listen, stream.Protocol)
+		StartHealthChecks("stream "+stream.name, stream.pool, stream.HealthCheck, nil)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// maxSubstitutionBuffer is the amount of data buffered while looking for the end of a line. Longer lines are processed
+// in parts, so regex matches can't span more than this many bytes.
+const maxSubstitutionBuffer = 64 * 1024
+
+// SubstitutionConfig describes replacements made in the body of proxied responses.
+// The body is processed line by line as it is received, so matches can't span multiple lines.
+type SubstitutionConfig struct {
+	// Content types the substitutions are applied to. "text/*" matches every text type. Default is text/html.
+	Types []string `yaml:"types,omitempty"`
+	// Replacements, applied in order.
+	Rules []SubstitutionRule `yaml:"rules"`
+}
+
+type SubstitutionRule struct {
+	// Text to look for, or a regex if Regex is set.
+	Match string `yaml:"match"`
+	// Replacement text. For regex rules, capture groups can be used as $1 or ${name}.
+	Replace string `yaml:"replace"`
+	Regex   bool   `yaml:"regex,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Compile compiles the regex rules. It must be called before NewReader.
+func (config *SubstitutionConfig) Compile() error {
+	if config == nil {
+		return nil
+	}
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Match == "" {
+			return errors.New("substitution rule without match")
+		}
+		if !rule.Regex {
+			continue
+		}
+		regex, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("invalid substitution rule %q: %v", rule.Match, err)
+		}
+		rule.regex = regex
+	}
+	return nil
+}
+
+// AppliesTo reports whether the substitutions must be applied to a response with this Content-Type.
+func (config *SubstitutionConfig) AppliesTo(contentType string) bool {
+	if config == nil || len(config.Rules) == 0 {
+		return false
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	types := config.Types
+	if len(types) == 0 {
+		types = []string{"text/html"}
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewReader returns a reader that applies the substitutions to the data read from in, as it is read.
+func (config *SubstitutionConfig) NewReader(in io.Reader) io.Reader {
+	keep := 0
+	for _, rule := range config.Rules {
+		if !rule.Regex && len(rule.Match)-1 > keep {
+			keep = len(rule.Match) - 1
+		}
+	}
+	return &substitutionReader{in: in, rules: config.Rules, keep: keep}
+}
+
+type substitutionReader struct {
+	in    io.Reader
+	rules []SubstitutionRule
+	// Number of bytes kept in the buffer when a long line is split, so that partial literal matches at its end are
+	// completed by the next read
+	keep    int
+	pending []byte
+	out     bytes.Buffer
+	err     error
+}
+
+func (r *substitutionReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.err != nil {
+			if len(r.pending) > 0 {
+				r.out.Write(r.apply(r.pending))
+				r.pending = nil
+				continue
+			}
+			return 0, r.err
+		}
+
+		chunk := make([]byte, 32*1024)
+		n, err := r.in.Read(chunk)
+		r.pending = append(r.pending, chunk[:n]...)
+		r.err = err
+
+		boundary := bytes.LastIndexByte(r.pending, '\n') + 1
+		if boundary == 0 && len(r.pending) > maxSubstitutionBuffer {
+			boundary = r.splitPoint()
+		}
+		if boundary > 0 {
+			r.out.Write(r.apply(r.pending[:boundary]))
+			r.pending = append([]byte(nil), r.pending[boundary:]...)
+		}
+	}
+	return r.out.Read(p)
+}
+
+// splitPoint returns where a long line without a line break is split. At least keep bytes are held back, and the
+// split is moved back to the start of any literal match it would cut, so that the match is replaced with the next part.
+func (r *substitutionReader) splitPoint() int {
+	split := len(r.pending) - r.keep
+	for moved := true; moved && split > 0; {
+		moved = false
+		for _, rule := range r.rules {
+			if rule.regex != nil {
+				continue
+			}
+			// Matches are found as bytes.ReplaceAll does, from the start and without overlapping
+			match := []byte(rule.Match)
+			for start := 0; ; {
+				i := bytes.Index(r.pending[start:], match)
+				if i < 0 || start+i >= split {
+					break
+				}
+				start += i + len(match)
+				if start > split {
+					split, moved = start-len(match), true
+					break
+				}
+			}
+		}
+	}
+	if split <= 0 {
+		// The whole buffer is overlapping matches, cut them
+		return len(r.pending) - r.keep
+	}
+	return split
+}
+
+func (r *substitutionReader) apply(data []byte) []byte {
+	for _, rule := range r.rules {
+		if rule.regex != nil {
+			data = rule.regex.ReplaceAll(data, []byte(rule.Replace))
+		} else {
+			data = bytes.ReplaceAll(data, []byte(rule.Match), []byte(rule.Replace))
+		}
+	}
+	return data
+}
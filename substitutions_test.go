@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSubstitutionReaderMatchAcrossSplit(t *testing.T) {
+	config := &SubstitutionConfig{Rules: []SubstitutionRule{
+		{Match: "</head>", Replace: "<script></script></head>"},
+		{Match: "http://internal.local", Replace: "https://example.com"},
+	}}
+	if err := config.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	// A line longer than maxSubstitutionBuffer is read in 32KB chunks and first split after three of them, minus the
+	// bytes held back for partial matches
+	firstSplit := 3*32*1024 - len("http://internal.local") + 1
+	for _, match := range []string{"</head>", "http://internal.local"} {
+		for offset := firstSplit - len(match) - 1; offset <= firstSplit+1; offset++ {
+			body := bytes.Repeat([]byte("x"), 200*1024)
+			copy(body[offset:], match)
+			want := config.applyAll(body)
+
+			got, err := io.ReadAll(config.NewReader(bytes.NewReader(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%q at offset %d: body differs from replacing the whole body, %d bytes instead of %d",
+					match, offset, len(got), len(want))
+			}
+		}
+	}
+}
+
+func (config *SubstitutionConfig) applyAll(body []byte) []byte {
+	return (&substitutionReader{rules: config.Rules}).apply(bytes.Clone(body))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Actions for TLS connections whose server name (SNI) doesn't match any host ("tls.unknown_sni").
+const (
+	UnknownSNITerminate   = "terminate"
+	UnknownSNIReject      = "reject"
+	UnknownSNIPassthrough = "passthrough"
+)
+
+// TLSPassthroughConfig forwards the TLS connections of a host to upstreams without terminating them, so that the
+// upstreams handle TLS themselves. Connections are routed using the server name (SNI) sent by the client.
+type TLSPassthroughConfig struct {
+	// Addresses receiving the TLS connections, e.g. "10.0.0.5:443". Connections are load balanced across them.
+	Upstreams []string `yaml:"upstreams"`
+	// PROXY protocol header to send to upstreams, carrying the client address: "v1" or "v2". Default is none.
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty"`
+	// Active checks of the upstreams. By default, upstreams are only skipped for a while after a connection to them
+	// failed.
+	HealthCheck *HealthCheckConfig `yaml:"health_check,omitempty"`
+}
+
+// NewPassthroughStream returns a TCP stream forwarding connections to the given upstreams.
+func NewPassthroughStream(name string, upstreams []string, proxyProtocol string) (*Stream, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("at least one TLS passthrough upstream is required")
+	}
+	for _, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return nil, fmt.Errorf("invalid TLS passthrough upstream %s: %v", upstream, err)
+		}
+	}
+	version, err := ParseProxyProtocolVersion(proxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{
+		Protocol:             "tcp",
+		Upstreams:            upstreams,
+		name:                 name,
+		pool:                 NewUpstreamPool(upstreams),
+		proxyProtocolVersion: version,
+	}, nil
+}
+
+var errClientHelloRead = errors.New("client hello read")
+
+// unrecognizedNameAlert is a TLS record with a fatal "unrecognized_name" alert (RFC 6066).
+var unrecognizedNameAlert = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x70}
+
+// readOnlyConn lets the TLS server read a ClientHello without sending anything to the client.
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn readOnlyConn) Read(b []byte) (int, error)  { return conn.reader.Read(b) }
+func (conn readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// ReadClientHelloServerName reads the TLS ClientHello sent on the connection and returns the server name it contains.
+// The bytes read from the connection are returned too, so that they can be replayed.
+func ReadClientHelloServerName(conn net.Conn) (string, []byte, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	var received bool
+	err := tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName, received = hello.ServerName, true
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !received {
+		return "", peeked.Bytes(), fmt.Errorf("failed to read TLS ClientHello: %w", err)
+	}
+	return serverName, peeked.Bytes(), nil
+}
+
+// peekedConn replays the bytes that were read from the connection before reading from it again.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn *peekedConn) Read(b []byte) (int, error) { return conn.reader.Read(b) }
+
+// NetConn returns the underlying connection.
+func (conn *peekedConn) NetConn() net.Conn { return conn.Conn }
+
+// SNIRouterListener reads the server name of incoming TLS connections before terminating them. Connections for hosts
+// with TLS passthrough are forwarded as is to their upstreams, and are never returned by Accept.
+type SNIRouterListener struct {
+	net.Listener
+	TLSConfig *tls.Config
+	Hosts     *HostStore
+	// Action for server names that don't match any host, see UnknownSNITerminate.
+	UnknownSNI string
+	// Stream for server names that don't match any host, if UnknownSNI is UnknownSNIPassthrough.
+	UnknownSNIStream *Stream
+
+	conns chan net.Conn
+	err   chan error
+}
+
+// NewSNIRouterListener starts routing the connections of the listener. The unknown SNI action is read from
+// "tls.unknown_sni", and its upstream from "tls.unknown_sni_upstream".
+func NewSNIRouterListener(listener net.Listener, tlsConfig *tls.Config, hosts *HostStore) (*SNIRouterListener, error) {
+	router := &SNIRouterListener{
+		Listener:   listener,
+		TLSConfig:  tlsConfig,
+		Hosts:      hosts,
+		UnknownSNI: strings.ToLower(GetConfigValue("tls.unknown_sni", UnknownSNITerminate).(string)),
+		conns:      make(chan net.Conn),
+		err:        make(chan error, 1),
+	}
+	switch router.UnknownSNI {
+	case UnknownSNITerminate, UnknownSNIReject:
+	case UnknownSNIPassthrough:
+		upstream := GetConfigValue("tls.unknown_sni_upstream", "").(string)
+		stream, err := NewPassthroughStream("unknown SNI", []string{upstream}, "")
+		if err != nil {
+			return nil, err
+		}
+		router.UnknownSNIStream = stream
+	default:
+		return nil, fmt.Errorf("unsupported tls.unknown_sni action: %s", router.UnknownSNI)
+	}
+	go router.serve()
+	return router, nil
+}
+
+func (router *SNIRouterListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-router.conns:
+		return conn, nil
+	case err := <-router.err:
+		// Keep the error for the next calls
+		router.err <- err
+		return nil, err
+	}
+}
+
+func (router *SNIRouterListener) serve() {
+	for {
+		conn, err := router.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				router.err <- err
+				return
+			}
+			println("Error accepting connection:", err.Error())
+			continue
+		}
+		go router.route(conn)
+	}
+}
+
+func (router *SNIRouterListener) route(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(ClientTimeout()))
+	serverName, peeked, err := ReadClientHelloServerName(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		ErrorLog(err)
+		conn.Close()
+		return
+	}
+	conn = &peekedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(peeked), conn)}
+
+	var passthrough *Stream
+	if host := MatchHost(router.Hosts.Hosts(), serverName); host != nil {
+		passthrough = host.passthrough
+	} else {
+		switch router.UnknownSNI {
+		case UnknownSNIReject:
+			// Fatal "unrecognized_name" alert, so that clients report the failure instead of a closed connection
+			_, _ = conn.Write(unrecognizedNameAlert)
+			conn.Close()
+			return
+		case UnknownSNIPassthrough:
+			passthrough = router.UnknownSNIStream
+		}
+	}
+	if passthrough != nil {
+		defer conn.Close()
+		ForwardTCPStream(passthrough, conn)
+		return
+	}
+	router.conns <- tls.Server(conn, router.TLSConfig)
+}
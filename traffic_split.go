@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strings"
+)
+
+// DefaultUpstreamGroup is the name of the group made of the upstreams of the location itself.
+const DefaultUpstreamGroup = "default"
+
+// SplitConfig routes part of the traffic of a location to other groups of upstreams, e.g. a canary version of a
+// service. Requests that are not routed to a group go to the upstreams of the location (the "default" group).
+type SplitConfig struct {
+	Groups []UpstreamGroup `yaml:"groups"`
+	// Rules selecting a group for specific requests, e.g. by header or cookie. Checked in order, before the weights.
+	Rules []SplitRule `yaml:"rules,omitempty"`
+	// How requests are assigned to groups by weight: "random" or "client_ip", which always assigns a client IP to the
+	// same group. Default is random.
+	HashBy string `yaml:"hash_by,omitempty"`
+	// Name of a cookie remembering the group assigned to a client by weight, so that clients don't switch between
+	// groups. Disabled if empty.
+	StickyCookie string `yaml:"sticky_cookie,omitempty"`
+	// Lifetime of the sticky cookie, in seconds. Default is 1 day.
+	StickyMaxAge int `yaml:"sticky_max_age,omitempty"`
+}
+
+type UpstreamGroup struct {
+	Name      string   `yaml:"name"`
+	Upstreams []string `yaml:"upstreams"`
+	// Percentage of the traffic routed to this group. The rest goes to the default group, so the weights must add up to
+	// 100 if the location has no upstreams of its own.
+	Weight float64 `yaml:"weight,omitempty"`
+
+	pool *UpstreamPool
+}
+
+// SplitRule selects a group for the requests having a header or cookie, optionally with a specific value.
+type SplitRule struct {
+	Header string `yaml:"header,omitempty"`
+	Cookie string `yaml:"cookie,omitempty"`
+	// Value the header or cookie must have. If empty, any value matches.
+	Value string `yaml:"value,omitempty"`
+	Group string `yaml:"group"`
+}
+
+// Prepare validates the groups and rules, and creates the upstream pools of the groups. Without default upstreams, i.e.
+// when the location has no upstreams of its own, every request must be routed to another group: the weights must add up
+// to 100 and rules can't select the default group.
+func (split *SplitConfig) Prepare(hasDefaultUpstreams bool) error {
+	if split == nil {
+		return nil
+	}
+	total := 0.0
+	names := map[string]bool{DefaultUpstreamGroup: true}
+	for i := range split.Groups {
+		group := &split.Groups[i]
+		if group.Name == "" || group.Name == DefaultUpstreamGroup || names[group.Name] {
+			return fmt.Errorf("invalid or duplicate upstream group name: %q", group.Name)
+		}
+		names[group.Name] = true
+		for _, address := range group.Upstreams {
+			if _, err := ParseUpstream(address); err != nil {
+				return fmt.Errorf("upstream group %s: %v", group.Name, err)
+			}
+		}
+		if group.Weight < 0 {
+			return fmt.Errorf("upstream group %s: negative weight", group.Name)
+		}
+		total += group.Weight
+		group.pool = NewUpstreamPool(group.Upstreams)
+	}
+	if total > 100 {
+		return fmt.Errorf("upstream group weights add up to more than 100")
+	}
+	if total < 100 && !hasDefaultUpstreams {
+		return fmt.Errorf("upstream group weights add up to %g instead of 100, and the location has no default upstreams",
+			total)
+	}
+	for _, rule := range split.Rules {
+		if !names[rule.Group] || (rule.Group == DefaultUpstreamGroup && !hasDefaultUpstreams) {
+			return fmt.Errorf("split rule refers to unknown upstream group %q", rule.Group)
+		}
+		if (rule.Header == "") == (rule.Cookie == "") {
+			return fmt.Errorf("split rule for group %s must have either a header or a cookie", rule.Group)
+		}
+	}
+	if split.HashBy != "" && split.HashBy != "random" && split.HashBy != "client_ip" {
+		return fmt.Errorf("unsupported split hash_by: %s", split.HashBy)
+	}
+	return nil
+}
+
+func (split *SplitConfig) group(name string) *UpstreamGroup {
+	for i := range split.Groups {
+		if split.Groups[i].Name == name {
+			return &split.Groups[i]
+		}
+	}
+	return nil
+}
+
+func (rule SplitRule) matches(request HttpRequest, cookies map[string]string) bool {
+	var value string
+	var ok bool
+	if rule.Header != "" {
+		value, ok = request.Headers[strings.ToLower(rule.Header)]
+	} else {
+		value, ok = cookies[rule.Cookie]
+	}
+	return ok && (rule.Value == "" || value == rule.Value)
+}
+
+// SelectUpstreamGroup returns the name and the upstream pool of the group a request is routed to. If a sticky cookie
+// must be sent to the client, it is returned as a Set-Cookie value.
+func (location HostLocation) SelectUpstreamGroup(request HttpRequest) (string, *UpstreamPool, string) {
+	split := location.Split
+	if split == nil || len(split.Groups) == 0 {
+		return DefaultUpstreamGroup, location.Pool(), ""
+	}
+	pool := func(name string) *UpstreamPool {
+		group := split.group(name)
+		if group == nil {
+			return location.Pool()
+		}
+		if group.pool == nil {
+			return NewUpstreamPool(group.Upstreams)
+		}
+		return group.pool
+	}
+
+	cookies := ParseCookies(request.Headers["cookie"])
+	for _, rule := range split.Rules {
+		if rule.matches(request, cookies) {
+			return rule.Group, pool(rule.Group), ""
+		}
+	}
+	if split.StickyCookie != "" {
+		if name, ok := cookies[split.StickyCookie]; ok && (name == DefaultUpstreamGroup || split.group(name) != nil) {
+			return name, pool(name), ""
+		}
+	}
+
+	var roll float64
+	if split.HashBy == "client_ip" {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(request.ClientIP))
+		roll = float64(hash.Sum32()%10000) / 100
+	} else {
+		roll = rand.Float64() * 100
+	}
+	name := DefaultUpstreamGroup
+	cumulative := 0.0
+	for _, group := range split.Groups {
+		cumulative += group.Weight
+		if roll < cumulative {
+			name = group.Name
+			break
+		}
+	}
+
+	cookie := ""
+	if split.StickyCookie != "" {
+		maxAge := split.StickyMaxAge
+		if maxAge <= 0 {
+			maxAge = 24 * 60 * 60
+		}
+		cookie = SetCookie(split.StickyCookie, name, StrPtr("/"), nil, IntPtr(maxAge), request.Scheme == "https", true, "")
+	}
+	return name, pool(name), cookie
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// UpstreamTLSConfig configures TLS connections to the upstreams of a location. It is only used for "https://" upstreams.
+type UpstreamTLSConfig struct {
+	// Path to a PEM file with the CA certificates used to verify upstreams. Default is the system roots.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Server name sent in the SNI extension and used to verify the upstream certificate. Default is the upstream hostname.
+	ServerName string `yaml:"server_name,omitempty"`
+	// Skip verification of upstream certificates. Only use this for testing.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+	// Minimum TLS version: 1.0, 1.1, 1.2 or 1.3. Default is 1.2.
+	MinVersion string `yaml:"min_version,omitempty"`
+	// Client certificate and private key presented to upstreams, for mutual TLS.
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+}
+
+// Build creates the tls.Config described by this configuration. A nil configuration builds the default config.
+func (config *UpstreamTLSConfig) Build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config == nil {
+		return tlsConfig, nil
+	}
+
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %s", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if config.CAFile != "" {
+		data, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	tlsConfig.ServerName = config.ServerName
+	tlsConfig.InsecureSkipVerify = config.InsecureSkipVerify
+	return tlsConfig, nil
+}
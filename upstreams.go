@@ -0,0 +1,122 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// UpstreamFailureCooldown is how long an upstream is skipped after a connection to it failed.
+const UpstreamFailureCooldown = 10 * time.Second
+
+// UpstreamPool load balances requests across the upstream addresses of a location using round-robin.
+// Members are the static addresses of the location, followed by the addresses found by discovery sources.
+type UpstreamPool struct {
+	mu         sync.Mutex
+	static     []string
+	discovered map[string][]string
+	members    []string
+	next       int
+}
+
+var upstreamFailuresMu sync.Mutex
+var upstreamFailures = make(map[string]time.Time)
+
+func NewUpstreamPool(members []string) *UpstreamPool {
+	return &UpstreamPool{static: members, members: members}
+}
+
+// Members returns a copy of the addresses in the pool.
+func (pool *UpstreamPool) Members() []string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return slices.Clone(pool.members)
+}
+
+// SetDiscovered replaces the addresses found by a discovery source, e.g. "dns". Static addresses are always kept.
+func (pool *UpstreamPool) SetDiscovered(source string, members []string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.discovered == nil {
+		pool.discovered = make(map[string][]string)
+	}
+	pool.discovered[source] = members
+	all := slices.Clone(pool.static)
+	for _, name := range slices.Sorted(maps.Keys(pool.discovered)) {
+		for _, member := range pool.discovered[name] {
+			if !slices.Contains(all, member) {
+				all = append(all, member)
+			}
+		}
+	}
+	pool.members = all
+}
+
+// Pick returns the next upstream address, skipping excluded and unhealthy members when possible.
+// If every member is excluded, the next member is returned anyway so that single-upstream locations can still retry.
+func (pool *UpstreamPool) Pick(exclude []string) (string, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.members) == 0 {
+		return "", false
+	}
+
+	var fallback string
+	for i := 0; i < len(pool.members); i++ {
+		member := pool.members[(pool.next+i)%len(pool.members)]
+		if slices.Contains(exclude, member) {
+			continue
+		}
+		if IsUpstreamHealthy(member) {
+			pool.next = (pool.next + i + 1) % len(pool.members)
+			return member, true
+		}
+		if fallback == "" {
+			fallback = member
+		}
+	}
+	if fallback != "" {
+		return fallback, true
+	}
+
+	member := pool.members[pool.next%len(pool.members)]
+	pool.next = (pool.next + 1) % len(pool.members)
+	return member, true
+}
+
+// MarkUpstreamFailed marks the upstream as unhealthy for UpstreamFailureCooldown.
+func MarkUpstreamFailed(address string) {
+	MarkUpstreamDown(address, UpstreamFailureCooldown)
+}
+
+// MarkUpstreamDown marks the upstream as unhealthy for the given duration, unless it is already unhealthy for longer.
+func MarkUpstreamDown(address string, duration time.Duration) {
+	upstreamFailuresMu.Lock()
+	defer upstreamFailuresMu.Unlock()
+	until := time.Now().Add(duration)
+	if until.After(upstreamFailures[address]) {
+		upstreamFailures[address] = until
+	}
+}
+
+// MarkUpstreamHealthy marks the upstream as healthy again, e.g. when a health check succeeds.
+func MarkUpstreamHealthy(address string) {
+	upstreamFailuresMu.Lock()
+	defer upstreamFailuresMu.Unlock()
+	delete(upstreamFailures, address)
+}
+
+func IsUpstreamHealthy(address string) bool {
+	upstreamFailuresMu.Lock()
+	defer upstreamFailuresMu.Unlock()
+	until, ok := upstreamFailures[address]
+	if !ok {
+		return true
+	}
+	if time.Now().After(until) {
+		delete(upstreamFailures, address)
+		return true
+	}
+	return false
+}
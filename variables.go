@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// NewRequestID returns a random identifier for a request.
+func NewRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RequestVariables returns the variables that can be used in content and header values, e.g. "$client_ip", including
+// the named captures of the location regex.
+func RequestVariables(request HttpRequest, location HostLocation) map[string]string {
+	path, query, _ := strings.Cut(request.Path, "?")
+	variables := map[string]string{
+		"user_agent":  request.Headers["user-agent"],
+		"remote_addr": request.ClientIP,
+		"client_ip":   request.ClientIP,
+		"host":        request.Headers["host"],
+		"path":        path,
+		"query":       query,
+		"request_uri": request.Path,
+		"method":      request.Method,
+		"scheme":      request.Scheme,
+		"request_id":  request.ID,
+		"tls_version": request.TLSVersion,
+		"location":    location.Match,
+	}
+	for name, value := range request.LocationCaptures {
+		variables[name] = value
+	}
+	return variables
+}
+
+// ExpandVariables replaces the "$name" and "${name}" placeholders in the string with the value of the variables, where
+// name is a whole identifier made of lowercase letters and underscores: "$hostname" is not "$host" followed by "name".
+// Placeholders of unknown variables are left as is. The string is scanned once, so that values containing "$name",
+// e.g. sent by the client, are never expanded themselves.
+func ExpandVariables(s string, variables map[string]string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var expanded strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			break
+		}
+		expanded.WriteString(s[:i])
+		name, placeholder := variableReference(s[i:])
+		if value, ok := variables[name]; ok && name != "" {
+			expanded.WriteString(value)
+		} else {
+			expanded.WriteString(placeholder)
+		}
+		s = s[i+len(placeholder):]
+	}
+	expanded.WriteString(s)
+	return expanded.String()
+}
+
+// variableReference returns the name of the variable referenced at the start of s, which starts with "$", and the
+// placeholder referencing it. The name is empty if s doesn't start with a placeholder.
+func variableReference(s string) (name, placeholder string) {
+	if strings.HasPrefix(s, "${") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 || !isVariableName(s[2:end]) {
+			return "", "$"
+		}
+		return s[2:end], s[:end+1]
+	}
+	end := 1
+	for end < len(s) && isVariableNameByte(s[end]) {
+		end++
+	}
+	return s[1:end], s[:end]
+}
+
+func isVariableName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if !isVariableNameByte(name[i]) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func isVariableNameByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z'
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestExpandVariables(t *testing.T) {
+	variables := map[string]string{
+		"host":        "example.com",
+		"request":     "REQUEST",
+		"request_uri": "/users?page=1",
+		"path":        "/users",
+		"client_ip":   "$host",
+	}
+	tests := []struct {
+		s, want string
+	}{
+		{"https://$host/", "https://example.com/"},
+		{"$hostname", "$hostname"},
+		{"${host}name", "example.comname"},
+		{"$request_uri", "/users?page=1"},
+		{"$request-$path", "REQUEST-/users"},
+		{"$path2", "/users2"},
+		{"$Host", "$Host"},
+		{"${unknown}", "${unknown}"},
+		{"${host", "${host"},
+		{"${}", "${}"},
+		{"${Host}", "${Host}"},
+		{"$client_ip", "$host"},
+		{"cost: $5", "cost: $5"},
+		{"$$host", "$example.com"},
+		{"$", "$"},
+		{"$host$path", "example.com/users"},
+	}
+	for _, test := range tests {
+		if got := ExpandVariables(test.s, variables); got != test.want {
+			t.Errorf("ExpandVariables(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
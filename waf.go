@@ -67,7 +67,7 @@ func MakeWAFChecks(request HttpRequest) WAFResult {
 	if val, ok := cookies["iridium_clearance"]; ok {
 		// Validate the token
 		tokenMap, err := DecompressWAFData(val)
-		if err == nil && tokenMap.UserAgent == request.Headers["user-agent"] && tokenMap.IP == request.Headers["x-forwarded-for"] {
+		if err == nil && tokenMap.UserAgent == request.Headers["user-agent"] && tokenMap.IP == request.ClientIP {
 			println("WAF: Valid clearance token, allowing request")
 			// Valid token, allow the request
 			return WAFResult{Blocked: false}
@@ -326,7 +326,7 @@ func CheckCaptchaSolution(captchaResponse string, provider string, secretKey str
 func CreateWAFSuccessToken(request HttpRequest) string {
 	data := make(map[string]interface{})
 	data["user_agent"] = request.Headers["user-agent"]
-	data["ip"] = request.Headers["x-forwarded-for"]
+	data["ip"] = request.ClientIP
 	data["accept_language"] = request.Headers["accept-language"]
 	data["accept_encoding"] = request.Headers["accept-encoding"]
 	return CompressWAFData(data)